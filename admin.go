@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// HandleAdmin registers the administrative handlers on `mux`. They change
+// the exporter's state, so they only accept POST requests:
+//   - /admin/reset-max-refresh-duration resets the max refresh duration
+//     metric.
+func (e *Exporter) HandleAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/reset-max-refresh-duration", e.handleResetMaxRefresh)
+}
+
+func (e *Exporter) handleResetMaxRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e.resetMaxRefresh()
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxRefreshDuration(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	for _, d := range []time.Duration{time.Second, 3 * time.Second, 2 * time.Second} {
+		e.observeRefresh(d)
+	}
+	if got := testutil.ToFloat64(e.metrics.maxRefreshDuration); got != 3 {
+		t.Errorf("got a max refresh duration of %vs, want 3s", got)
+	}
+
+	admin := http.NewServeMux()
+	e.HandleAdmin(admin)
+	if w := scrape(t, admin, "/admin/reset-max-refresh-duration"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for a GET, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/reset-max-refresh-duration", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := testutil.ToFloat64(e.metrics.maxRefreshDuration); got != 0 {
+		t.Errorf("got a max refresh duration of %vs after a reset, want 0", got)
+	}
+	e.observeRefresh(time.Second)
+	if got := testutil.ToFloat64(e.metrics.maxRefreshDuration); got != 1 {
+		t.Errorf("got a max refresh duration of %vs, want 1s", got)
+	}
+}
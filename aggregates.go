@@ -0,0 +1,567 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// servedOnlyStations returns, per province, the number of stations that report
+// at least one served price and no self-service price. Records without station
+// metadata are ignored, since they cannot be attributed to a province.
+func servedOnlyStations(records []*Record, stations map[int]Station) map[string]int {
+	type variants struct {
+		self, served bool
+	}
+	seen := make(map[int]*variants)
+	for _, record := range records {
+		v, ok := seen[record.IDImpianto]
+		if !ok {
+			v = &variants{}
+			seen[record.IDImpianto] = v
+		}
+		if record.SelfService {
+			v.self = true
+		} else {
+			v.served = true
+		}
+	}
+	counts := make(map[string]int)
+	for id, v := range seen {
+		station, ok := stations[id]
+		if !ok {
+			continue
+		}
+		// provinces with no served-only stations are still reported, as 0.
+		n := counts[station.Provincia]
+		if v.served && !v.self {
+			n++
+		}
+		counts[station.Provincia] = n
+	}
+	return counts
+}
+
+// distinctBrands returns, per province, the number of distinct brands
+// (Bandiera) among the known stations. Stations with an empty brand are
+// ignored.
+func distinctBrands(stations map[int]Station) map[string]int {
+	brands := make(map[string]map[string]struct{})
+	for _, station := range stations {
+		if station.Bandiera == "" {
+			continue
+		}
+		b, ok := brands[station.Provincia]
+		if !ok {
+			b = make(map[string]struct{})
+			brands[station.Provincia] = b
+		}
+		b[station.Bandiera] = struct{}{}
+	}
+	counts := make(map[string]int, len(brands))
+	for provincia, b := range brands {
+		counts[provincia] = len(b)
+	}
+	return counts
+}
+
+// welford accumulates the running mean and variance of a series of values
+// using Welford's online algorithm, which is numerically stable.
+type welford struct {
+	n    int
+	mean float64
+	m2   float64
+}
+
+func (w *welford) Add(x float64) {
+	w.n++
+	delta := x - w.mean
+	w.mean += delta / float64(w.n)
+	w.m2 += delta * (x - w.mean)
+}
+
+// StdDev returns the population standard deviation of the values added so
+// far, or 0 if there are fewer than two values.
+func (w *welford) StdDev() float64 {
+	if w.n < 2 {
+		return 0
+	}
+	return math.Sqrt(w.m2 / float64(w.n))
+}
+
+// ewma is an exponentially weighted moving average. It is safe for
+// concurrent use.
+type ewma struct {
+	mu sync.Mutex
+	// alpha is the weight of a new value, between 0 and 1: the higher, the
+	// faster the average follows the recent values.
+	alpha float64
+	value float64
+	init  bool
+}
+
+// Add adds a value and returns the updated average. The first value
+// initializes the average.
+func (a *ewma) Add(x float64) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.init {
+		a.value, a.init = x, true
+	} else {
+		a.value = a.alpha*x + (1-a.alpha)*a.value
+	}
+	return a.value
+}
+
+// fuelProvince is the key used for aggregates by fuel type and province.
+type fuelProvince struct {
+	Carburante string
+	Provincia  string
+}
+
+// lowSampleGroups returns the fuel type and province groups with fewer than
+// `minSamples` prices, whose statistics are not meaningful. Records without
+// station metadata are ignored.
+func lowSampleGroups(records []*Record, stations map[int]Station, minSamples int) map[fuelProvince]bool {
+	counts := make(map[fuelProvince]int)
+	for _, record := range records {
+		station, ok := stations[record.IDImpianto]
+		if !ok {
+			continue
+		}
+		counts[fuelProvince{Carburante: record.Carburante, Provincia: station.Provincia}]++
+	}
+	low := make(map[fuelProvince]bool)
+	for k, n := range counts {
+		if n < minSamples {
+			low[k] = true
+		}
+	}
+	return low
+}
+
+// priceSummary is the minimum, maximum and average of a group of prices.
+type priceSummary struct {
+	Min, Max, Avg float64
+}
+
+// provincePrices returns the summary of the prices, per fuel type and
+// province. Records without station metadata are ignored.
+func provincePrices(records []*Record, stations map[int]Station) map[fuelProvince]priceSummary {
+	type group struct {
+		min, max float64
+		avg      welford
+	}
+	groups := make(map[fuelProvince]*group)
+	for _, record := range records {
+		station, ok := stations[record.IDImpianto]
+		if !ok {
+			continue
+		}
+		k := fuelProvince{Carburante: record.Carburante, Provincia: station.Provincia}
+		g, ok := groups[k]
+		if !ok {
+			g = &group{min: record.Prezzo, max: record.Prezzo}
+			groups[k] = g
+		}
+		g.min = math.Min(g.min, record.Prezzo)
+		g.max = math.Max(g.max, record.Prezzo)
+		g.avg.Add(record.Prezzo)
+	}
+	ret := make(map[fuelProvince]priceSummary, len(groups))
+	for k, g := range groups {
+		ret[k] = priceSummary{Min: g.min, Max: g.max, Avg: g.avg.mean}
+	}
+	return ret
+}
+
+// priceStdDev returns the standard deviation of the prices, per fuel type and
+// province. Records without station metadata are ignored.
+func priceStdDev(records []*Record, stations map[int]Station) map[fuelProvince]float64 {
+	groups := make(map[fuelProvince]*welford)
+	for _, record := range records {
+		station, ok := stations[record.IDImpianto]
+		if !ok {
+			continue
+		}
+		k := fuelProvince{Carburante: record.Carburante, Provincia: station.Provincia}
+		w, ok := groups[k]
+		if !ok {
+			w = &welford{}
+			groups[k] = w
+		}
+		w.Add(record.Prezzo)
+	}
+	ret := make(map[fuelProvince]float64, len(groups))
+	for k, w := range groups {
+		ret[k] = w.StdDev()
+	}
+	return ret
+}
+
+// stationDensity returns, per region, the number of stations per 100k
+// residents. Stations in unknown provinces, and regions without population
+// data, are skipped.
+func stationDensity(stations map[int]Station) map[string]float64 {
+	counts := make(map[string]int)
+	for _, station := range stations {
+		regione, ok := provinceRegions[station.Provincia]
+		if !ok {
+			continue
+		}
+		counts[regione]++
+	}
+	ret := make(map[string]float64, len(counts))
+	for regione, count := range counts {
+		population := regionPopulation[regione]
+		if population == 0 {
+			continue
+		}
+		ret[regione] = float64(count) * 100000 / float64(population)
+	}
+	return ret
+}
+
+// duplicatePriceRows returns the number of records that are exact duplicates
+// of a record seen earlier in the same data set.
+func duplicatePriceRows(records []*Record) int {
+	type key struct {
+		id         int
+		carburante string
+		self       bool
+		prezzo     float64
+		data       int64
+	}
+	seen := make(map[key]struct{}, len(records))
+	duplicates := 0
+	for _, record := range records {
+		k := key{
+			id:         record.IDImpianto,
+			carburante: record.Carburante,
+			self:       record.SelfService,
+			prezzo:     record.Prezzo,
+			data:       record.DataComunicazione.UnixNano(),
+		}
+		if _, ok := seen[k]; ok {
+			duplicates++
+			continue
+		}
+		seen[k] = struct{}{}
+	}
+	return duplicates
+}
+
+// selfServiceSavings returns, per fuel type and province, the average
+// difference between the served and the self-service price, over the
+// stations that report both. Records without station metadata are ignored.
+func selfServiceSavings(records []*Record, stations map[int]Station) map[fuelProvince]float64 {
+	type stationFuel struct {
+		id         int
+		carburante string
+	}
+	type variants struct {
+		self, served       float64
+		hasSelf, hasServed bool
+	}
+	prices := make(map[stationFuel]*variants)
+	for _, record := range records {
+		k := stationFuel{id: record.IDImpianto, carburante: record.Carburante}
+		v, ok := prices[k]
+		if !ok {
+			v = &variants{}
+			prices[k] = v
+		}
+		if record.SelfService {
+			v.self, v.hasSelf = record.Prezzo, true
+		} else {
+			v.served, v.hasServed = record.Prezzo, true
+		}
+	}
+	type sum struct {
+		total float64
+		n     int
+	}
+	sums := make(map[fuelProvince]*sum)
+	for k, v := range prices {
+		if !v.hasSelf || !v.hasServed {
+			continue
+		}
+		station, ok := stations[k.id]
+		if !ok {
+			continue
+		}
+		fp := fuelProvince{Carburante: k.carburante, Provincia: station.Provincia}
+		s, ok := sums[fp]
+		if !ok {
+			s = &sum{}
+			sums[fp] = s
+		}
+		s.total += v.served - v.self
+		s.n++
+	}
+	ret := make(map[fuelProvince]float64, len(sums))
+	for k, s := range sums {
+		ret[k] = s.total / float64(s.n)
+	}
+	return ret
+}
+
+// regionNewestReport returns, per region, the most recent report time among
+// the records of its stations. Records without station metadata, or in
+// unknown provinces, are ignored.
+func regionNewestReport(records []*Record, stations map[int]Station) map[string]time.Time {
+	newest := make(map[string]time.Time)
+	for _, record := range records {
+		station, ok := stations[record.IDImpianto]
+		if !ok {
+			continue
+		}
+		regione, ok := provinceRegions[station.Provincia]
+		if !ok {
+			continue
+		}
+		if record.DataComunicazione.After(newest[regione]) {
+			newest[regione] = record.DataComunicazione
+		}
+	}
+	return newest
+}
+
+// autostradaleSurcharge returns, per fuel type, the national average price
+// at motorway stations minus the one at the other stations. Fuel types not
+// sold at both kinds of station, and records without station metadata, are
+// ignored.
+func autostradaleSurcharge(records []*Record, stations map[int]Station) map[string]float64 {
+	type averages struct {
+		autostradale, stradale welford
+	}
+	fuels := make(map[string]*averages)
+	for _, record := range records {
+		station, ok := stations[record.IDImpianto]
+		if !ok {
+			continue
+		}
+		a, ok := fuels[record.Carburante]
+		if !ok {
+			a = &averages{}
+			fuels[record.Carburante] = a
+		}
+		switch station.Tipo {
+		case StationTypeAutostradale:
+			a.autostradale.Add(record.Prezzo)
+		case StationTypeStradale:
+			a.stradale.Add(record.Prezzo)
+		}
+	}
+	ret := make(map[string]float64, len(fuels))
+	for carburante, a := range fuels {
+		if a.autostradale.n == 0 || a.stradale.n == 0 {
+			continue
+		}
+		ret[carburante] = a.autostradale.mean - a.stradale.mean
+	}
+	return ret
+}
+
+// nationalAverages returns the national average price per fuel type.
+func nationalAverages(records []*Record) map[string]float64 {
+	fuels := make(map[string]*welford)
+	for _, record := range records {
+		w, ok := fuels[record.Carburante]
+		if !ok {
+			w = &welford{}
+			fuels[record.Carburante] = w
+		}
+		w.Add(record.Prezzo)
+	}
+	ret := make(map[string]float64, len(fuels))
+	for carburante, w := range fuels {
+		ret[carburante] = w.mean
+	}
+	return ret
+}
+
+// regionFuel is the key used for aggregates by region and fuel type.
+type regionFuel struct {
+	Regione    string
+	Carburante string
+}
+
+// regionCheapest returns the lowest price per region and fuel type. Records
+// without station metadata, or in unknown provinces, are ignored.
+func regionCheapest(records []*Record, stations map[int]Station) map[regionFuel]float64 {
+	cheapest := make(map[regionFuel]float64)
+	for _, record := range records {
+		station, ok := stations[record.IDImpianto]
+		if !ok {
+			continue
+		}
+		regione, ok := provinceRegions[station.Provincia]
+		if !ok {
+			continue
+		}
+		k := regionFuel{Regione: regione, Carburante: record.Carburante}
+		if price, ok := cheapest[k]; !ok || record.Prezzo < price {
+			cheapest[k] = record.Prezzo
+		}
+	}
+	return cheapest
+}
+
+// autostradaleRatio returns, per region, the fraction of stations that are on
+// a motorway. Stations in unknown provinces are ignored.
+func autostradaleRatio(stations map[int]Station) map[string]float64 {
+	type count struct {
+		autostradale, total int
+	}
+	counts := make(map[string]*count)
+	for _, station := range stations {
+		regione, ok := provinceRegions[station.Provincia]
+		if !ok {
+			continue
+		}
+		c, ok := counts[regione]
+		if !ok {
+			c = &count{}
+			counts[regione] = c
+		}
+		c.total++
+		if station.Tipo == StationTypeAutostradale {
+			c.autostradale++
+		}
+	}
+	ret := make(map[string]float64, len(counts))
+	for regione, c := range counts {
+		if c.total == 0 {
+			continue
+		}
+		ret[regione] = float64(c.autostradale) / float64(c.total)
+	}
+	return ret
+}
+
+// reportsPerHour returns the number of records reported within the last 24
+// hours, per hour of the day of their report time.
+func reportsPerHour(records []*Record, now time.Time) [24]int {
+	var counts [24]int
+	for _, record := range records {
+		if now.Sub(record.DataComunicazione) > 24*time.Hour {
+			continue
+		}
+		counts[record.DataComunicazione.Hour()]++
+	}
+	return counts
+}
+
+// reportedRatio returns the fraction of records whose price was reported by
+// the station, see Record.Reported. It returns false if there are no records.
+func reportedRatio(records []*Record) (float64, bool) {
+	if len(records) == 0 {
+		return 0, false
+	}
+	reported := 0
+	for _, record := range records {
+		if record.Reported {
+			reported++
+		}
+	}
+	return float64(reported) / float64(len(records)), true
+}
+
+// recencyBuckets are the buckets of stationsByRecency, by maximum age of the
+// latest report of a station, in increasing order. The last one has no
+// maximum.
+var recencyBuckets = []struct {
+	name   string
+	maxAge time.Duration
+}{
+	{"<1d", 24 * time.Hour},
+	{"1-3d", 3 * 24 * time.Hour},
+	{"3-7d", 7 * 24 * time.Hour},
+	{">7d", 0},
+}
+
+// stationsByRecency returns the number of stations per recency bucket, see
+// recencyBuckets, according to the age of their latest report at `now`.
+// Every bucket is present, even if empty.
+func stationsByRecency(records []*Record, now time.Time) map[string]int {
+	latest := make(map[int]time.Time)
+	for _, record := range records {
+		if record.DataComunicazione.After(latest[record.IDImpianto]) {
+			latest[record.IDImpianto] = record.DataComunicazione
+		}
+	}
+	counts := make(map[string]int, len(recencyBuckets))
+	for _, b := range recencyBuckets {
+		counts[b.name] = 0
+	}
+	for _, ts := range latest {
+		age := now.Sub(ts)
+		for _, b := range recencyBuckets {
+			if b.maxAge == 0 || age < b.maxAge {
+				counts[b.name]++
+				break
+			}
+		}
+	}
+	return counts
+}
+
+// referencePrice returns the reference price of a fuel type, matched
+// case-insensitively, and false if there is none.
+func referencePrice(references map[string]float64, carburante string) (float64, bool) {
+	if price, ok := references[carburante]; ok {
+		return price, true
+	}
+	for fuel, price := range references {
+		if strings.EqualFold(fuel, carburante) {
+			return price, true
+		}
+	}
+	return 0, false
+}
+
+// emptyProvinces returns the number of known provinces, see provinceRegions,
+// without any price record.
+func emptyProvinces(records []*Record, stations map[int]Station) int {
+	seen := make(map[string]bool)
+	for _, record := range records {
+		if station, ok := stations[record.IDImpianto]; ok {
+			seen[station.Provincia] = true
+		}
+	}
+	empty := 0
+	for provincia := range provinceRegions {
+		if !seen[provincia] {
+			empty++
+		}
+	}
+	return empty
+}
+
+// fuelPrevalence returns, per fuel type, the ratio of the stations with a
+// price for it to all the stations. Records without station metadata are
+// ignored.
+func fuelPrevalence(records []*Record, stations map[int]Station) map[string]float64 {
+	if len(stations) == 0 {
+		return nil
+	}
+	offering := make(map[string]map[int]bool)
+	for _, record := range records {
+		if _, ok := stations[record.IDImpianto]; !ok {
+			continue
+		}
+		ids, ok := offering[record.Carburante]
+		if !ok {
+			ids = make(map[int]bool)
+			offering[record.Carburante] = ids
+		}
+		ids[record.IDImpianto] = true
+	}
+	ret := make(map[string]float64, len(offering))
+	for carburante, ids := range offering {
+		ret[carburante] = float64(len(ids)) / float64(len(stations))
+	}
+	return ret
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServedOnlyStations(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "RM"},
+		3: {ID: 3, Provincia: "RM"},
+		4: {ID: 4, Provincia: "MI"},
+	}
+	records := []*Record{
+		// served only
+		{IDImpianto: 1, Carburante: "Benzina", SelfService: false},
+		{IDImpianto: 1, Carburante: "Gasolio", SelfService: false},
+		// both
+		{IDImpianto: 2, Carburante: "Benzina", SelfService: false},
+		{IDImpianto: 2, Carburante: "Benzina", SelfService: true},
+		// self only
+		{IDImpianto: 3, Carburante: "Benzina", SelfService: true},
+		{IDImpianto: 4, Carburante: "Benzina", SelfService: true},
+		// no station metadata
+		{IDImpianto: 5, Carburante: "Benzina", SelfService: false},
+	}
+	want := map[string]int{"RM": 1, "MI": 0}
+	if got := servedOnlyStations(records, stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDistinctBrands(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM", Bandiera: "Eni"},
+		2: {ID: 2, Provincia: "RM", Bandiera: "Q8"},
+		3: {ID: 3, Provincia: "RM", Bandiera: "Eni"},
+		4: {ID: 4, Provincia: "RM", Bandiera: ""},
+		5: {ID: 5, Provincia: "MI", Bandiera: "IP"},
+	}
+	want := map[string]int{"RM": 2, "MI": 1}
+	if got := distinctBrands(stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPriceStdDev(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "MI"},
+	}
+	var records []*Record
+	// the population standard deviation of these values is 2.
+	for _, prezzo := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		records = append(records, &Record{IDImpianto: 1, Carburante: "Benzina", Prezzo: prezzo})
+	}
+	records = append(records, &Record{IDImpianto: 2, Carburante: "Benzina", Prezzo: 1.9})
+	got := priceStdDev(records, stations)
+	if v := got[fuelProvince{Carburante: "Benzina", Provincia: "RM"}]; math.Abs(v-2) > 1e-9 {
+		t.Errorf("got a stddev of %v, want 2", v)
+	}
+	if v := got[fuelProvince{Carburante: "Benzina", Provincia: "MI"}]; v != 0 {
+		t.Errorf("got a stddev of %v for a single price, want 0", v)
+	}
+}
+
+func TestStationDensity(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "LT"},
+		// unknown province
+		3: {ID: 3, Provincia: "XX"},
+	}
+	want := map[string]float64{"Lazio": 2 * 100000 / float64(regionPopulation["Lazio"])}
+	if got := stationDensity(stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSelfServiceSavings(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "RM"},
+		3: {ID: 3, Provincia: "RM"},
+	}
+	records := []*Record{
+		{IDImpianto: 1, Carburante: "Benzina", Prezzo: 2, SelfService: false},
+		{IDImpianto: 1, Carburante: "Benzina", Prezzo: 1.75, SelfService: true},
+		{IDImpianto: 2, Carburante: "Benzina", Prezzo: 2.5, SelfService: false},
+		{IDImpianto: 2, Carburante: "Benzina", Prezzo: 2, SelfService: true},
+		// self only
+		{IDImpianto: 3, Carburante: "Benzina", Prezzo: 1, SelfService: true},
+	}
+	want := map[fuelProvince]float64{{Carburante: "Benzina", Provincia: "RM"}: 0.375}
+	if got := selfServiceSavings(records, stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRegionNewestReport(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "LT"},
+		3: {ID: 3, Provincia: "MI"},
+	}
+	t0 := time.Date(2023, 10, 12, 8, 0, 0, 0, time.UTC)
+	records := []*Record{
+		{IDImpianto: 1, DataComunicazione: t0},
+		{IDImpianto: 2, DataComunicazione: t0.Add(time.Hour)},
+		{IDImpianto: 3, DataComunicazione: t0.Add(-time.Hour)},
+	}
+	want := map[string]time.Time{
+		"Lazio":     t0.Add(time.Hour),
+		"Lombardia": t0.Add(-time.Hour),
+	}
+	if got := regionNewestReport(records, stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAutostradaleRatio(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM", Tipo: StationTypeAutostradale},
+		2: {ID: 2, Provincia: "RM", Tipo: StationTypeStradale},
+		3: {ID: 3, Provincia: "LT", Tipo: StationTypeStradale},
+		4: {ID: 4, Provincia: "FR", Tipo: StationTypeStradale},
+		5: {ID: 5, Provincia: "MI", Tipo: StationTypeStradale},
+	}
+	want := map[string]float64{"Lazio": 0.25, "Lombardia": 0}
+	if got := autostradaleRatio(stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReportsPerHour(t *testing.T) {
+	now := time.Date(2023, 10, 12, 20, 30, 0, 0, time.UTC)
+	at := func(day, hour int) *Record {
+		return &Record{DataComunicazione: time.Date(2023, 10, day, hour, 15, 0, 0, time.UTC)}
+	}
+	records := []*Record{
+		at(12, 8), at(12, 8), at(12, 8),
+		at(12, 9),
+		// yesterday, within the last 24 hours
+		at(11, 21),
+		// more than 24 hours ago
+		at(11, 8),
+	}
+	var want [24]int
+	want[8], want[9], want[21] = 3, 1, 1
+	if got := reportsPerHour(records, now); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReportedRatio(t *testing.T) {
+	if _, ok := reportedRatio(nil); ok {
+		t.Error("got a ratio without records")
+	}
+	records := []*Record{
+		{Reported: true},
+		{Reported: true},
+		{Reported: true},
+		{Reported: false},
+	}
+	if got, ok := reportedRatio(records); !ok || got != 0.75 {
+		t.Errorf("got %v, %t, want 0.75, true", got, ok)
+	}
+}
+
+func TestRegionCheapest(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "LT"},
+		3: {ID: 3, Provincia: "MI"},
+	}
+	records := []*Record{
+		{IDImpianto: 1, Carburante: "Benzina", Prezzo: 1.899},
+		{IDImpianto: 2, Carburante: "Benzina", Prezzo: 1.849},
+		{IDImpianto: 2, Carburante: "Gasolio", Prezzo: 1.799},
+		{IDImpianto: 3, Carburante: "Benzina", Prezzo: 1.999},
+		// no station metadata
+		{IDImpianto: 4, Carburante: "Benzina", Prezzo: 1.099},
+	}
+	want := map[regionFuel]float64{
+		{Regione: "Lazio", Carburante: "Benzina"}:     1.849,
+		{Regione: "Lazio", Carburante: "Gasolio"}:     1.799,
+		{Regione: "Lombardia", Carburante: "Benzina"}: 1.999,
+	}
+	if got := regionCheapest(records, stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	a := &ewma{alpha: 0.5}
+	// e.g. 1000 records parsed in 10s, then in 5s three times.
+	for i, tt := range []struct {
+		rate, want float64
+	}{
+		{100, 100},
+		{200, 150},
+		{200, 175},
+		{200, 187.5},
+	} {
+		if got := a.Add(tt.rate); got != tt.want {
+			t.Errorf("refresh %d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestAutostradaleSurcharge(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Tipo: StationTypeAutostradale},
+		2: {ID: 2, Tipo: StationTypeAutostradale},
+		3: {ID: 3, Tipo: StationTypeStradale},
+		4: {ID: 4, Tipo: StationTypeStradale},
+	}
+	records := []*Record{
+		{IDImpianto: 1, Carburante: "Benzina", Prezzo: 2.25},
+		{IDImpianto: 2, Carburante: "Benzina", Prezzo: 2.0},
+		{IDImpianto: 3, Carburante: "Benzina", Prezzo: 1.75},
+		{IDImpianto: 4, Carburante: "Benzina", Prezzo: 1.875},
+		// only sold at motorway stations
+		{IDImpianto: 1, Carburante: "GNL", Prezzo: 1.5},
+	}
+	// (2.25+2)/2 - (1.75+1.875)/2
+	want := map[string]float64{"Benzina": 0.3125}
+	if got := autostradaleSurcharge(records, stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStationsByRecency(t *testing.T) {
+	now := time.Date(2023, 10, 12, 8, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	records := []*Record{
+		// the latest report of a station counts
+		{IDImpianto: 1, DataComunicazione: now.Add(-10 * day)},
+		{IDImpianto: 1, DataComunicazione: now.Add(-time.Hour)},
+		{IDImpianto: 2, DataComunicazione: now.Add(-2 * day)},
+		{IDImpianto: 3, DataComunicazione: now.Add(-5 * day)},
+		{IDImpianto: 4, DataComunicazione: now.Add(-6 * day)},
+		{IDImpianto: 5, DataComunicazione: now.Add(-30 * day)},
+	}
+	want := map[string]int{"<1d": 1, "1-3d": 1, "3-7d": 2, ">7d": 1}
+	if got := stationsByRecency(records, now); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestEmptyProvinces(t *testing.T) {
+	if got := len(provinceRegions); got != 107 {
+		t.Fatalf("got %d known provinces, want 107", got)
+	}
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "MI"},
+		// without records
+		3: {ID: 3, Provincia: "FI"},
+		// unknown province
+		4: {ID: 4, Provincia: "XX"},
+	}
+	records := []*Record{
+		{IDImpianto: 1, Carburante: "Benzina"},
+		{IDImpianto: 1, Carburante: "Gasolio"},
+		{IDImpianto: 2, Carburante: "Benzina"},
+		{IDImpianto: 4, Carburante: "Benzina"},
+		// no station metadata
+		{IDImpianto: 5, Carburante: "Benzina"},
+	}
+	if got := emptyProvinces(records, stations); got != 105 {
+		t.Errorf("got %d empty provinces, want 105", got)
+	}
+}
+
+func TestFuelPrevalence(t *testing.T) {
+	if got := fuelPrevalence(nil, nil); got != nil {
+		t.Errorf("got %v without stations, want nil", got)
+	}
+	stations := map[int]Station{
+		1: {ID: 1},
+		2: {ID: 2},
+		3: {ID: 3},
+		// without prices
+		4: {ID: 4},
+	}
+	records := []*Record{
+		{IDImpianto: 1, Carburante: "Benzina", SelfService: true},
+		{IDImpianto: 1, Carburante: "Benzina", SelfService: false},
+		{IDImpianto: 1, Carburante: "Gasolio"},
+		{IDImpianto: 2, Carburante: "Benzina"},
+		{IDImpianto: 3, Carburante: "Benzina"},
+		{IDImpianto: 3, Carburante: "GPL"},
+		// no station metadata
+		{IDImpianto: 5, Carburante: "Metano"},
+	}
+	want := map[string]float64{"Benzina": 0.75, "Gasolio": 0.25, "GPL": 0.25}
+	if got := fuelPrevalence(records, stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProvincePrices(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "RM"},
+		3: {ID: 3, Provincia: "RM"},
+	}
+	records := []*Record{
+		{IDImpianto: 1, Carburante: "Benzina", Prezzo: 1.875},
+		{IDImpianto: 2, Carburante: "Benzina", Prezzo: 1.75},
+		{IDImpianto: 3, Carburante: "Benzina", Prezzo: 2},
+		// no station metadata
+		{IDImpianto: 4, Carburante: "Benzina", Prezzo: 1},
+	}
+	want := map[fuelProvince]priceSummary{
+		{Carburante: "Benzina", Provincia: "RM"}: {Min: 1.75, Max: 2, Avg: 1.875},
+	}
+	if got := provincePrices(records, stations); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PriceEntry is a price record joined with the metadata of its station, as
+// returned by the API and the CSV export.
+type PriceEntry struct {
+	IDImpianto        int       `json:"id_impianto"`
+	Carburante        string    `json:"carburante"`
+	Prezzo            Price     `json:"prezzo"`
+	SelfService       bool      `json:"self_service"`
+	DataComunicazione time.Time `json:"data_comunicazione"`
+	Nome              string    `json:"nome"`
+	Bandiera          string    `json:"bandiera"`
+	Tipo              string    `json:"tipo"`
+	Comune            string    `json:"comune"`
+	Provincia         string    `json:"provincia"`
+}
+
+// Price is a price that is serialized with a configurable decimal separator.
+// With the default "." separator it is serialized to JSON as a number,
+// otherwise as a string. If Precision is greater than zero, it is rounded to
+// that many decimals.
+type Price struct {
+	Value            float64
+	DecimalSeparator string
+	Precision        int
+}
+
+func (p Price) String() string {
+	precision := -1
+	if p.Precision > 0 {
+		precision = p.Precision
+	}
+	s := strconv.FormatFloat(p.Value, 'f', precision, 64)
+	if p.DecimalSeparator != "" && p.DecimalSeparator != "." {
+		s = strings.Replace(s, ".", p.DecimalSeparator, 1)
+	}
+	return s
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	if p.DecimalSeparator == "" || p.DecimalSeparator == "." {
+		return []byte(p.String()), nil
+	}
+	return json.Marshal(p.String())
+}
+
+// newPriceEntry joins a record with its station, if known.
+func newPriceEntry(record *Record, stations map[int]Station, decimalSeparator string, precision int) PriceEntry {
+	station := stations[record.IDImpianto]
+	return PriceEntry{
+		IDImpianto:        record.IDImpianto,
+		Carburante:        record.Carburante,
+		Prezzo:            Price{Value: record.Prezzo, DecimalSeparator: decimalSeparator, Precision: precision},
+		SelfService:       record.SelfService,
+		DataComunicazione: record.DataComunicazione,
+		Nome:              station.Nome,
+		Bandiera:          station.Bandiera,
+		Tipo:              string(station.Tipo),
+		Comune:            station.Comune,
+		Provincia:         station.Provincia,
+	}
+}
+
+var priceEntryCSVHeader = []string{"IDImpianto", "Carburante", "Prezzo", "SelfService", "DataComunicazione", "Nome", "Bandiera", "Tipo", "Comune", "Provincia"}
+
+func (p PriceEntry) csvRecord() []string {
+	return []string{
+		strconv.Itoa(p.IDImpianto),
+		p.Carburante,
+		p.Prezzo.String(),
+		strconv.FormatBool(p.SelfService),
+		p.DataComunicazione.Format(time.DateTime),
+		p.Nome,
+		p.Bandiera,
+		p.Tipo,
+		p.Comune,
+		p.Provincia,
+	}
+}
+
+// StationEntry is a station with all of its current prices, as returned by
+// the API.
+type StationEntry struct {
+	ID        int                 `json:"id"`
+	Gestore   string              `json:"gestore"`
+	Bandiera  string              `json:"bandiera"`
+	Tipo      string              `json:"tipo"`
+	Nome      string              `json:"nome"`
+	Indirizzo string              `json:"indirizzo"`
+	Comune    string              `json:"comune"`
+	Provincia string              `json:"provincia"`
+	Lat       string              `json:"lat"`
+	Long      string              `json:"long"`
+	Prices    []StationPriceEntry `json:"prices"`
+}
+
+// StationPriceEntry is one of the prices of a StationEntry.
+type StationPriceEntry struct {
+	Carburante        string    `json:"carburante"`
+	Prezzo            Price     `json:"prezzo"`
+	SelfService       bool      `json:"self_service"`
+	DataComunicazione time.Time `json:"data_comunicazione"`
+}
+
+// HandleAPI registers the API and export handlers on `mux`:
+//   - /api/prices returns the current prices as JSON;
+//   - /api/station/{id} returns a station with its current prices as JSON;
+//   - /api/metrics-catalog returns the list of metrics the exporter can emit;
+//   - /export.csv returns the current prices as a semicolon-separated CSV;
+//   - /snapshot.csv refreshes the data, unless it was refreshed less than
+//     MinRefreshInterval ago, and returns it like /export.csv.
+func (e *Exporter) HandleAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/prices", e.cachedAPI(e.handlePrices))
+	mux.HandleFunc("/api/station/", e.cachedAPI(e.handleStation))
+	mux.HandleFunc("/api/metrics-catalog", e.handleMetricsCatalog)
+	mux.HandleFunc("/export.csv", e.cachedAPI(e.handleExportCSV))
+	mux.HandleFunc("/snapshot.csv", e.handleSnapshotCSV)
+}
+
+// apiResponse is a successful API response, as cached by cachedAPI.
+type apiResponse struct {
+	contentType string
+	body        []byte
+}
+
+// responseBuffer is an http.ResponseWriter buffering the response in memory.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header         { return b.header }
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *responseBuffer) WriteHeader(status int)      { b.status = status }
+
+// cachedAPI wraps an API handler so that its successful responses are cached
+// for APICacheTTL, keyed by the path and the query string. The cache is
+// cleared whenever the data is updated, see updateStore, and the keys include
+// the time of the snapshot, so that a response computed from the previous
+// snapshot and cached after the update is never served.
+func (e *Exporter) cachedAPI(h http.HandlerFunc) http.HandlerFunc {
+	if e.cfg.APICacheTTL <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Encode sorts the parameters, so that their order does not matter.
+		key := strconv.FormatInt(e.store.Snapshot().Updated.UnixNano(), 10) + " " + r.Method + " " + r.URL.Path + "?" + r.URL.Query().Encode()
+		if cached, ok := e.apiCache.Get(key); ok && len(cached) == 1 {
+			w.Header().Set("Content-Type", cached[0].contentType)
+			w.Write(cached[0].body)
+			return
+		}
+		buf := &responseBuffer{header: w.Header(), status: http.StatusOK}
+		h(buf, r)
+		if buf.status == http.StatusOK {
+			e.apiCache.Set(key, apiResponse{contentType: w.Header().Get("Content-Type"), body: buf.body.Bytes()})
+		}
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+	}
+}
+
+func (e *Exporter) priceEntries() []PriceEntry {
+	snap := e.store.Snapshot()
+	entries := make([]PriceEntry, 0, len(snap.Records))
+	for _, record := range snap.Records {
+		entries = append(entries, newPriceEntry(record, snap.Stations, e.cfg.DecimalSeparator, e.cfg.PricePrecision))
+	}
+	return entries
+}
+
+func (e *Exporter) handlePrices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(e.priceEntries()); err != nil {
+		log.Printf("Failed to write prices response: %v", err)
+	}
+}
+
+func (e *Exporter) handleStation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/station/"))
+	if err != nil {
+		http.Error(w, "station ID must be numeric", http.StatusBadRequest)
+		return
+	}
+	snap := e.store.Snapshot()
+	station, ok := snap.Stations[id]
+	entry := StationEntry{
+		ID:        id,
+		Gestore:   station.Gestore,
+		Bandiera:  station.Bandiera,
+		Tipo:      string(station.Tipo),
+		Nome:      station.Nome,
+		Indirizzo: station.Indirizzo,
+		Comune:    station.Comune,
+		Provincia: station.Provincia,
+		Lat:       station.Lat,
+		Long:      station.Long,
+		Prices:    []StationPriceEntry{},
+	}
+	for _, record := range snap.Records {
+		if record.IDImpianto != id {
+			continue
+		}
+		entry.Prices = append(entry.Prices, StationPriceEntry{
+			Carburante:        record.Carburante,
+			Prezzo:            Price{Value: record.Prezzo, DecimalSeparator: e.cfg.DecimalSeparator, Precision: e.cfg.PricePrecision},
+			SelfService:       record.SelfService,
+			DataComunicazione: record.DataComunicazione,
+		})
+	}
+	// stations without metadata are still known if they report prices.
+	if !ok && len(entry.Prices) == 0 {
+		http.Error(w, "station not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		log.Printf("Failed to write station response: %v", err)
+	}
+}
+
+func (e *Exporter) handleMetricsCatalog(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(e.metrics.catalog.Metrics()); err != nil {
+		log.Printf("Failed to write metrics catalog response: %v", err)
+	}
+}
+
+func (e *Exporter) handleExportCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writeCSV(w, e.priceEntries())
+}
+
+func (e *Exporter) handleSnapshotCSV(w http.ResponseWriter, r *http.Request) {
+	// refreshIfStale serializes the refreshes: concurrent requests wait for
+	// the one in progress and then serve its data, or fail with it.
+	if err := e.refreshIfStale(r.Context()); err != nil {
+		log.Printf("Snapshot refresh failed: %v", err)
+		http.Error(w, "failed to refresh data", http.StatusServiceUnavailable)
+		return
+	}
+	e.handleExportCSV(w, r)
+}
+
+// writeCSV writes the entries as a semicolon-separated CSV, like the MIMIT
+// files, so that a comma decimal separator does not need quoting.
+func writeCSV(w io.Writer, entries []PriceEntry) {
+	cw := csv.NewWriter(w)
+	cw.Comma = ';'
+	if err := cw.Write(priceEntryCSVHeader); err != nil {
+		log.Printf("Failed to write CSV header: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if err := cw.Write(entry.csvRecord()); err != nil {
+			log.Printf("Failed to write CSV record: %v", err)
+			return
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Failed to write CSV: %v", err)
+	}
+}
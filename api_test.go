@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExportCSVDecimalSeparator(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	for _, tt := range []struct {
+		separator string
+		want      string
+	}{
+		{"", "1.899"},
+		{",", "1,899"},
+	} {
+		e := newTestExporter(t, srv, Config{DecimalSeparator: tt.separator})
+		if err := e.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		mux := http.NewServeMux()
+		e.HandleAPI(mux)
+		w := scrape(t, mux, "/export.csv")
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		if !strings.Contains(w.Body.String(), ";Benzina;"+tt.want+";true;") {
+			t.Errorf("price %s not found with separator %q in:\n%s", tt.want, tt.separator, w.Body.String())
+		}
+	}
+}
+
+func TestAPIStation(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	e.HandleAPI(mux)
+
+	w := scrape(t, mux, "/api/station/1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var got struct {
+		ID     int    `json:"id"`
+		Nome   string `json:"nome"`
+		Prices []struct {
+			Carburante  string  `json:"carburante"`
+			Prezzo      float64 `json:"prezzo"`
+			SelfService bool    `json:"self_service"`
+		} `json:"prices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got.ID != 1 || got.Nome != "Eni Roma" || len(got.Prices) != 2 {
+		t.Errorf("got %+v, want station 1 with its 2 prices", got)
+	}
+	for _, p := range got.Prices {
+		if (p.Carburante == "Benzina" && p.Prezzo != 1.899) || (p.Carburante == "Gasolio" && p.Prezzo != 1.799) {
+			t.Errorf("got price %+v", p)
+		}
+	}
+
+	if w := scrape(t, mux, "/api/station/42"); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown station, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAPIMetricsCatalog(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	mux := http.NewServeMux()
+	e.HandleAPI(mux)
+	w := scrape(t, mux, "/api/metrics-catalog")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var catalog []MetricInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &catalog); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	for _, m := range catalog {
+		if m.Name != "osservatorio_carburanti_price" {
+			continue
+		}
+		if m.Type != "gauge" || !reflect.DeepEqual(m.Labels, priceLabels) {
+			t.Errorf("got %+v, want a gauge with labels %v", m, priceLabels)
+		}
+		return
+	}
+	t.Errorf("price gauge not found in the catalog %+v", catalog)
+}
+
+func TestSnapshotCSV(t *testing.T) {
+	var downloads atomic.Int32
+	var prices atomic.Value
+	prices.Store(testPricesCSV)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		io.WriteString(w, prices.Load().(string))
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{MinRefreshInterval: time.Hour})
+	api := http.NewServeMux()
+	e.HandleAPI(api)
+
+	// the data refreshed by Run is fresh enough.
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	w := scrape(t, api, "/snapshot.csv")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := downloads.Load(); got != 1 {
+		t.Errorf("got %d downloads, want only the one of Refresh", got)
+	}
+	rows, err := parseSnapshotCSV(w.Body.String())
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(rows) != 4 || !reflect.DeepEqual(rows[0], priceEntryCSVHeader) {
+		t.Errorf("got %v, want the header and 3 prices", rows)
+	}
+
+	// stale data is downloaded again, once for concurrent requests.
+	prices.Store(strings.Replace(testPricesCSV, "1.999", "2.049", 1))
+	e.refreshMu.Lock()
+	e.lastRefresh = time.Now().Add(-2 * time.Hour)
+	e.refreshMu.Unlock()
+	e.setLastSuccess(time.Now().Add(-2 * time.Hour))
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = scrape(t, api, "/snapshot.csv").Body.String()
+		}(i)
+	}
+	wg.Wait()
+	if got := downloads.Load(); got != 2 {
+		t.Errorf("got %d downloads, want 2", got)
+	}
+	for _, body := range bodies {
+		if !strings.Contains(body, ";2.049;") {
+			t.Errorf("updated price not found in:\n%s", body)
+		}
+	}
+}
+
+// parseSnapshotCSV parses a CSV export, see writeCSV.
+func parseSnapshotCSV(s string) ([][]string, error) {
+	r := csv.NewReader(strings.NewReader(s))
+	r.Comma = ';'
+	return r.ReadAll()
+}
+
+func TestSnapshotCSVRefreshFailure(t *testing.T) {
+	var downloads atomic.Int32
+	var up atomic.Bool
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		<-release
+		if !up.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{MinRefreshInterval: time.Hour})
+	api := http.NewServeMux()
+	e.HandleAPI(api)
+
+	// the requests waiting for a failed refresh fail with it.
+	codes := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = scrape(t, api, "/snapshot.csv").Code
+		}(i)
+	}
+	for downloads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// let the other requests queue up behind the refresh.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("request %d: got status %d, want %d", i, code, http.StatusServiceUnavailable)
+		}
+	}
+	if got := downloads.Load(); got != 1 {
+		t.Errorf("got %d downloads for concurrent requests, want 1", got)
+	}
+
+	// a failed refresh does not delay the next one, and a request
+	// cancelled by its client does not cancel it.
+	up.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/snapshot.csv", nil).WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d after the upstream recovered, want %d", w.Code, http.StatusOK)
+	}
+	if got := downloads.Load(); got != 2 {
+		t.Errorf("got %d downloads, want 2", got)
+	}
+}
+
+func TestCachedAPI(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{APICacheTTL: time.Hour})
+	var calls int
+	h := e.cachedAPI(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		io.WriteString(w, "response")
+	})
+	// the order of the parameters does not matter.
+	for _, target := range []string{"/api/search?q=roma&limit=1", "/api/search?limit=1&q=roma"} {
+		if body := scrape(t, h, target).Body.String(); body != "response" {
+			t.Errorf("got body %q, want %q", body, "response")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls for two identical queries, want 1", calls)
+	}
+	scrape(t, h, "/api/search?q=milano")
+	if calls != 2 {
+		t.Errorf("got %d calls after a different query, want 2", calls)
+	}
+
+	// a new snapshot invalidates the cache.
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	scrape(t, h, "/api/search?q=roma&limit=1")
+	if calls != 3 {
+		t.Errorf("got %d calls after a refresh, want 3", calls)
+	}
+}
+
+func TestCachedAPISnapshotSwap(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{APICacheTTL: time.Hour})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	var calls int
+	h := e.cachedAPI(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		records := len(e.store.Snapshot().Records)
+		if calls == 1 {
+			// the snapshot is swapped while the response is computed
+			// from the previous one.
+			snap := e.store.Snapshot()
+			e.updateStore(snap.Records[:1], snap.Stations, snap.StationsUpdated)
+		}
+		fmt.Fprint(w, records)
+	})
+	if body := scrape(t, h, "/api/search?q=roma").Body.String(); body != "3" {
+		t.Errorf("got body %q, want %q", body, "3")
+	}
+	if body := scrape(t, h, "/api/search?q=roma").Body.String(); body != "1" {
+		t.Errorf("got body %q from the previous snapshot, want %q", body, "1")
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2", calls)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+)
+
+// auditedStationFields are the station metadata fields whose changes are
+// logged by auditStations.
+var auditedStationFields = []struct {
+	name  string
+	value func(Station) string
+}{
+	{"Gestore", func(s Station) string { return s.Gestore }},
+	{"Bandiera", func(s Station) string { return s.Bandiera }},
+	{"Tipo", func(s Station) string { return string(s.Tipo) }},
+	{"Nome", func(s Station) string { return s.Nome }},
+	{"Indirizzo", func(s Station) string { return s.Indirizzo }},
+	{"Comune", func(s Station) string { return s.Comune }},
+	{"Provincia", func(s Station) string { return s.Provincia }},
+	{"Lat", func(s Station) string { return s.Lat }},
+	{"Long", func(s Station) string { return s.Long }},
+}
+
+// auditStations logs an event to `logger` for every metadata field that
+// changed between the old and the new stations, ordered by station ID.
+// Stations that were added or removed are not logged.
+func auditStations(logger *slog.Logger, old, stations map[int]Station) {
+	ids := make([]int, 0, len(stations))
+	for id := range stations {
+		if _, ok := old[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		prev, cur := old[id], stations[id]
+		for _, field := range auditedStationFields {
+			if before, after := field.value(prev), field.value(cur); before != after {
+				logger.Info("Station metadata changed", "station", id, "field", field.name, "old", before, "new", after)
+			}
+		}
+	}
+}
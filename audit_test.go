@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAuditStationChanges(t *testing.T) {
+	var stations atomic.Value
+	stations.Store(testStationsCSV)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, stations.Load().(string))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	var buf bytes.Buffer
+	e := newTestExporter(t, srv, Config{AuditLogger: slog.New(slog.NewJSONHandler(&buf, nil))})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got audit events for the first stations: %s", buf.String())
+	}
+
+	stations.Store(strings.Replace(testStationsCSV, "Eni Roma", "Eni Roma Centro", 1))
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	var event struct {
+		Msg     string `json:"msg"`
+		Station int    `json:"station"`
+		Field   string `json:"field"`
+		Old     string `json:"old"`
+		New     string `json:"new"`
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d audit events, want 1: %s", len(lines), buf.String())
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("invalid audit event: %v", err)
+	}
+	if event.Station != 1 || event.Field != "Nome" || event.Old != "Eni Roma" || event.New != "Eni Roma Centro" {
+		t.Errorf("got audit event %+v, want the change of the name of station 1", event)
+	}
+}
@@ -1,53 +1,130 @@
 package main
 
 import (
+	"context"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-type CacheEntry struct {
-	Records []Record
-	Ts      time.Time
+type CacheEntry[V any] struct {
+	Values []V
+	Ts     time.Time
 }
 
-type Cache struct {
-	entries map[string]*CacheEntry
+type Cache[V any] struct {
+	entries map[string]*CacheEntry[V]
 	TTL     time.Duration
-	mu      sync.Mutex
+	// HitAge, if not nil, observes the age in seconds of the entries returned
+	// by Get.
+	HitAge prometheus.Observer
+	// MaxEntries, if greater than zero, is the maximum number of keys: Set
+	// evicts the least recently set one to store a new key.
+	MaxEntries int
+	mu         sync.Mutex
+	// now returns the current time, it is only replaced in tests.
+	now func() time.Time
 }
 
 // Get returns the cached item, and a boolean indicating whether the item was found or not.
 // If the cached item has expired, a `nil` object and `false` are returned.
-func (c *Cache) Get(k string) ([]Record, bool) {
+func (c *Cache[V]) Get(k string) ([]V, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	e, ok := c.entries[k]
 	if ok {
-		if time.Since(e.Ts) > c.TTL {
+		age := c.now().Sub(e.Ts)
+		if age > c.TTL {
 			return nil, false
 		}
-		return e.Records, true
+		if c.HitAge != nil {
+			c.HitAge.Observe(age.Seconds())
+		}
+		return e.Values, true
 	}
 	return nil, false
 }
 
-func (c *Cache) Put(k string, v Record) {
+func (c *Cache[V]) Put(k string, v V) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	entry, ok := c.entries[k]
 	if ok {
-		entry.Records = append(entry.Records, v)
+		entry.Values = append(entry.Values, v)
 	} else {
-		entry = &CacheEntry{
-			Records: []Record{v},
-			Ts:      time.Now(),
+		c.entries[k] = &CacheEntry[V]{
+			Values: []V{v},
+			Ts:     c.now(),
 		}
 	}
 }
 
-func NewCache(ttl time.Duration) *Cache {
-	return &Cache{
-		entries: make(map[string]*CacheEntry),
+// Set replaces the cached values of a key, resetting their age.
+func (c *Cache[V]) Set(k string, values ...V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[k]; !ok && c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		c.evictOldest()
+	}
+	c.entries[k] = &CacheEntry[V]{
+		Values: values,
+		Ts:     c.now(),
+	}
+}
+
+// Clear removes all the cached items.
+func (c *Cache[V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*CacheEntry[V])
+}
+
+// evictOldest removes the least recently set item. The caller must hold mu.
+func (c *Cache[V]) evictOldest() {
+	var oldest string
+	var oldestTs time.Time
+	for k, e := range c.entries {
+		if oldestTs.IsZero() || e.Ts.Before(oldestTs) {
+			oldest, oldestTs = k, e.Ts
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// evictExpired removes the expired items, that Get would not return anyway.
+func (c *Cache[V]) evictExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if now.Sub(e.Ts) > c.TTL {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// StartJanitor starts a goroutine removing the expired items every
+// `interval`, until the context is cancelled.
+func (c *Cache[V]) StartJanitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.evictExpired()
+			}
+		}
+	}()
+}
+
+func NewCache[V any](ttl time.Duration) *Cache[V] {
+	return &Cache[V]{
+		entries: make(map[string]*CacheEntry[V]),
 		TTL:     ttl,
+		now:     time.Now,
 	}
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCacheHitAge(t *testing.T) {
+	hitAge := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_cache_hit_age_seconds"})
+	c := NewCache[int](time.Hour)
+	c.HitAge = hitAge
+	now := time.Now()
+	c.now = func() time.Time { return now.Add(-30 * time.Second) }
+	c.Set("k", 1)
+	c.now = func() time.Time { return now }
+	if _, ok := c.Get("k"); !ok {
+		t.Fatal("seeded entry not found")
+	}
+
+	var m dto.Metric
+	if err := hitAge.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("got %d observations, want 1", got)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got != 30 {
+		t.Errorf("got an observed age of %vs, want 30s", got)
+	}
+}
+
+func TestCachePutGet(t *testing.T) {
+	c := NewCache[int](time.Hour)
+	if _, ok := c.Get("k"); ok {
+		t.Fatal("got a value from an empty cache")
+	}
+	c.Put("k", 1)
+	if got, ok := c.Get("k"); !ok || !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("got %v, %t after putting a new key, want [1], true", got, ok)
+	}
+	// putting to an existing key appends.
+	c.Put("k", 2)
+	if got, ok := c.Get("k"); !ok || !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("got %v, %t after putting to an existing key, want [1 2], true", got, ok)
+	}
+	// Set replaces.
+	c.Set("k", 3)
+	if got, ok := c.Get("k"); !ok || !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("got %v, %t after setting the key, want [3], true", got, ok)
+	}
+}
+
+func TestRefreshCacheHits(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{CacheTTL: time.Hour})
+	for i := 0; i < 2; i++ {
+		if err := e.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+	}
+	// the second refresh finds the unchanged prices in the cache.
+	var m dto.Metric
+	if err := e.metrics.cacheHitAge.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 3 {
+		t.Errorf("got %d cache hits, want 3", got)
+	}
+	if got := len(e.cache.entries); got != 3 {
+		t.Errorf("got %d cached records, want 3", got)
+	}
+}
+
+func TestCacheEvictExpired(t *testing.T) {
+	c := NewCache[int](time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.Set("k", 1)
+	c.evictExpired()
+	if len(c.entries) != 1 {
+		t.Fatalf("got %d entries before the TTL, want 1", len(c.entries))
+	}
+	c.now = func() time.Time { return now.Add(2 * time.Minute) }
+	c.evictExpired()
+	if len(c.entries) != 0 {
+		t.Errorf("got %d entries after the TTL, want 0", len(c.entries))
+	}
+}
+
+func TestCacheStartJanitor(t *testing.T) {
+	c := NewCache[int](time.Millisecond)
+	c.Set("k", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.StartJanitor(ctx, time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		n := len(c.entries)
+		c.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the janitor did not remove the expired entry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	c := NewCache[int](time.Hour)
+	c.MaxEntries = 2
+	now := time.Now()
+	for i, k := range []string{"a", "b", "c"} {
+		c.now = func() time.Time { return now.Add(time.Duration(i) * time.Second) }
+		c.Set(k, i)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("the least recently set key was not evicted")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("key %q was evicted", k)
+		}
+	}
+	// replacing an existing key does not evict.
+	c.Set("b", 4)
+	if _, ok := c.Get("c"); !ok {
+		t.Error("setting an existing key evicted another one")
+	}
+}
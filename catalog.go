@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricInfo describes a metric that the exporter can emit.
+type MetricInfo struct {
+	Name   string   `json:"name"`
+	Help   string   `json:"help"`
+	Type   string   `json:"type"`
+	Labels []string `json:"labels"`
+}
+
+// catalog records the definition of every metric created through it, so that
+// the list of metrics exposed by /api/metrics-catalog cannot drift from the
+// actual ones. A nil catalog creates metrics without recording them.
+type catalog struct {
+	metrics []MetricInfo
+}
+
+func (c *catalog) add(name, help, typ string, labels []string) {
+	if c == nil {
+		return
+	}
+	if labels == nil {
+		labels = []string{}
+	}
+	c.metrics = append(c.metrics, MetricInfo{Name: name, Help: help, Type: typ, Labels: labels})
+}
+
+// remove removes a metric from the catalog, for metrics that are created but
+// end up not being exported.
+func (c *catalog) remove(name string) {
+	if c == nil {
+		return
+	}
+	metrics := c.metrics[:0]
+	for _, m := range c.metrics {
+		if m.Name != name {
+			metrics = append(metrics, m)
+		}
+	}
+	c.metrics = metrics
+}
+
+// Metrics returns the recorded metrics, sorted by name.
+func (c *catalog) Metrics() []MetricInfo {
+	ret := make([]MetricInfo, len(c.metrics))
+	copy(ret, c.metrics)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func (c *catalog) gauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	c.add(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, "gauge", nil)
+	return prometheus.NewGauge(opts)
+}
+
+func (c *catalog) gaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	c.add(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, "gauge", labels)
+	return prometheus.NewGaugeVec(opts, labels)
+}
+
+// desc returns the desc of a gauge exported by a custom collector.
+func (c *catalog) desc(opts prometheus.GaugeOpts, labels []string) *prometheus.Desc {
+	name := prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	c.add(name, opts.Help, "gauge", labels)
+	return prometheus.NewDesc(name, opts.Help, labels, opts.ConstLabels)
+}
+
+func (c *catalog) gaugeFunc(opts prometheus.GaugeOpts, fn func() float64) prometheus.GaugeFunc {
+	c.add(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, "gauge", nil)
+	return prometheus.NewGaugeFunc(opts, fn)
+}
+
+func (c *catalog) counter(opts prometheus.CounterOpts) prometheus.Counter {
+	c.add(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, "counter", nil)
+	return prometheus.NewCounter(opts)
+}
+
+func (c *catalog) counterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	c.add(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, "counter", labels)
+	return prometheus.NewCounterVec(opts, labels)
+}
+
+func (c *catalog) histogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	c.add(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, "histogram", nil)
+	return prometheus.NewHistogram(opts)
+}
+
+func (c *catalog) histogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	c.add(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, "histogram", labels)
+	return prometheus.NewHistogramVec(opts, labels)
+}
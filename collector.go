@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// priceLabelValues returns the values of the price labels, see priceLabels,
+// for the given record. Labels coming from station metadata are empty if the
+// station is unknown.
+func priceLabelValues(record *Record, stations map[int]Station) []string {
+	var nome, tipo, comune, provincia, bandiera string
+	station, ok := stations[record.IDImpianto]
+	if ok {
+		nome = station.Nome
+		tipo = string(station.Tipo)
+		comune = station.Comune
+		provincia = station.Provincia
+		bandiera = station.Bandiera
+	}
+	return []string{
+		strconv.FormatInt(int64(record.IDImpianto), 10), // IDImpianto
+		record.Carburante,                      // Carburante
+		strconv.FormatBool(record.SelfService), // SelfService
+		nome,                                   // Nome
+		tipo,                                   // Tipo
+		comune,                                 // Comune
+		provincia,                              // Provincia
+		bandiera,                               // Bandiera
+	}
+}
+
+// priceRecords returns the records of the snapshot whose prices are exported:
+// all of them, or only the ones with station metadata if `dropOrphans` is
+// set.
+func priceRecords(snap Snapshot, dropOrphans bool) []*Record {
+	if !dropOrphans {
+		return snap.Records
+	}
+	records := make([]*Record, 0, len(snap.Records))
+	for _, record := range snap.Records {
+		if _, ok := snap.Stations[record.IDImpianto]; ok {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// isOldSample returns true if the record was reported more than `maxAge` ago.
+func isOldSample(record *Record, maxAge time.Duration) bool {
+	return time.Since(record.DataComunicazione) > maxAge
+}
+
+// priceAge returns the time between the report of the record and `now`.
+// Report times in the future have no age.
+func priceAge(record *Record, now time.Time) time.Duration {
+	age := now.Sub(record.DataComunicazione)
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// priceCollector exports the prices in the store at scrape time, optionally
+// restricted to the records matching a filter.
+// With useReportTimestamp, the report time is used as sample timestamp.
+// Prometheus rejects samples that are too old, so records older than `maxAge`
+// are exported without a timestamp, i.e. with the scrape time.
+type priceCollector struct {
+	desc *prometheus.Desc
+	// categoryDescs, if not nil, replaces desc with a metric per fuel
+	// category, see fuelCategory.
+	categoryDescs      map[string]*prometheus.Desc
+	store              *Store
+	filter             *Filter
+	useReportTimestamp bool
+	maxAge             time.Duration
+	dropOrphans        bool
+	asciiLabels        bool
+	// pricePrecision is the number of decimals of the exported prices, see
+	// roundPrice.
+	pricePrecision int
+}
+
+// labelValues returns the price label values of the record, folded to ASCII
+// if asciiLabels is set.
+func (c *priceCollector) labelValues(record *Record, stations map[int]Station) []string {
+	values := priceLabelValues(record, stations)
+	if c.asciiLabels {
+		values = asciiLabelValues(values)
+	}
+	return values
+}
+
+// descFor returns the desc of the metric exporting the price of the record.
+func (c *priceCollector) descFor(record *Record) *prometheus.Desc {
+	if c.categoryDescs != nil {
+		return c.categoryDescs[fuelCategory(record.Carburante)]
+	}
+	return c.desc
+}
+
+func (c *priceCollector) Describe(ch chan<- *prometheus.Desc) {
+	if c.categoryDescs != nil {
+		for _, desc := range c.categoryDescs {
+			ch <- desc
+		}
+		return
+	}
+	ch <- c.desc
+}
+
+// series returns the records to export from the snapshot, keyed by their
+// label values. Like with a GaugeVec, the last record wins when several
+// records map to the same label values: emitting both would fail the scrape.
+func (c *priceCollector) series(snap Snapshot) map[string]*Record {
+	records := priceRecords(snap, c.dropOrphans)
+	series := make(map[string]*Record, len(records))
+	for _, record := range records {
+		if c.filter != nil && !c.filter.Match(record, snap.Stations) {
+			continue
+		}
+		series[strings.Join(c.labelValues(record, snap.Stations), "\xff")] = record
+	}
+	return series
+}
+
+// SeriesCount returns the number of price series currently exported.
+func (c *priceCollector) SeriesCount() int {
+	return len(c.series(c.store.Snapshot()))
+}
+
+func (c *priceCollector) Collect(ch chan<- prometheus.Metric) {
+	snap := c.store.Snapshot()
+	for _, record := range c.series(snap) {
+		desc := c.descFor(record)
+		m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, roundPrice(record.Prezzo, c.pricePrecision), c.labelValues(record, snap.Stations)...)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+			continue
+		}
+		if c.useReportTimestamp && !isOldSample(record, c.maxAge) {
+			m = prometheus.NewMetricWithTimestamp(record.DataComunicazione, m)
+		}
+		ch <- m
+	}
+}
+
+// snapshotCollector exports a gauge computed at scrape time from the
+// current snapshot of the store. Unlike a GaugeVec that is reset and set
+// again after each refresh, it is never seen partially updated.
+type snapshotCollector struct {
+	desc  *prometheus.Desc
+	store *Store
+	// collect calls `set` for every series of the gauge.
+	collect func(snap Snapshot, set func(value float64, labelValues ...string))
+}
+
+func (c *snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(c.store.Snapshot(), func(value float64, labelValues ...string) {
+		m, err := prometheus.NewConstMetric(c.desc, prometheus.GaugeValue, value, labelValues...)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(c.desc, err)
+		}
+		ch <- m
+	})
+}
+
+// registerSeriesMetrics registers on `reg` a gauge with the number of price
+// series exported by `prices`, and a gauge that is always 1. Together, they
+// tell apart an exporter that is up but exports no series, e.g. because of a
+// too restrictive filter, from one that is down. The metrics are recorded in
+// `c`, unless it is nil.
+func registerSeriesMetrics(reg prometheus.Registerer, prices *priceCollector, c *catalog) error {
+	seriesCount := c.gaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "osservatorio_carburanti_series_count",
+			Help: "Number of price series currently exported",
+		},
+		func() float64 { return float64(prices.SeriesCount()) },
+	)
+	if err := reg.Register(seriesCount); err != nil {
+		return fmt.Errorf("failed to register series count metric: %w", err)
+	}
+	active := c.gaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "osservatorio_carburanti_active",
+			Help: "Always 1 while the exporter is running",
+		},
+		func() float64 { return 1 },
+	)
+	if err := reg.Register(active); err != nil {
+		return fmt.Errorf("failed to register active metric: %w", err)
+	}
+	return nil
+}
+
+// CarburantiCollector is a prometheus.Collector exporting the prices like
+// priceCollector, that first refreshes the data if it was last refreshed
+// more than MinRefreshInterval ago. It lets the data be refreshed on scrape
+// by whatever gathers it, without running the refresh loop.
+type CarburantiCollector struct {
+	e      *Exporter
+	prices *priceCollector
+}
+
+// NewCarburantiCollector returns a CarburantiCollector exporting all the
+// prices of the exporter.
+func (e *Exporter) NewCarburantiCollector() *CarburantiCollector {
+	return &CarburantiCollector{e: e, prices: e.newPriceCollector(nil)}
+}
+
+func (c *CarburantiCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.prices.Describe(ch)
+}
+
+func (c *CarburantiCollector) Collect(ch chan<- prometheus.Metric) {
+	// the previous data is exported if the refresh fails. Downloads are
+	// bounded by HTTPTimeout.
+	if err := c.e.refreshIfStale(context.Background()); err != nil {
+		log.Printf("Refresh failed: %v", err)
+	}
+	c.prices.Collect(ch)
+}
+
+// aggregatesCollector exports the aggregate metrics, see metrics.aggregates,
+// computing them from the current snapshot at scrape time.
+type aggregatesCollector struct {
+	e          *Exporter
+	collectors []prometheus.Collector
+	// mu serializes the scrapes, that reset and set the same metrics.
+	mu sync.Mutex
+}
+
+// newAggregatesCollector returns an aggregatesCollector exporting
+// `collectors`.
+func (e *Exporter) newAggregatesCollector(collectors []prometheus.Collector) *aggregatesCollector {
+	return &aggregatesCollector{e: e, collectors: collectors}
+}
+
+func (c *aggregatesCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors {
+		collector.Describe(ch)
+	}
+}
+
+func (c *aggregatesCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.e.collectAggregates(c.e.store.Snapshot())
+	for _, collector := range c.collectors {
+		collector.Collect(ch)
+	}
+}
+
+// provinceGatherer gathers the metrics from `g`, dropping the ones with a
+// Provincia label that is not in `provinces`. Matching is case-insensitive.
+// Metrics without a Provincia label are kept.
+type provinceGatherer struct {
+	g         prometheus.Gatherer
+	provinces []string
+}
+
+func (p provinceGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := p.g.Gather()
+	return filterFamilies(mfs, func(_ *dto.MetricFamily, m *dto.Metric) bool {
+		return p.match(m)
+	}), err
+}
+
+// filterFamilies keeps only the metrics of `mfs` for which `keep` returns
+// true, dropping the families left without metrics. The families are
+// modified in place: Gather returns new ones on every call.
+func filterFamilies(mfs []*dto.MetricFamily, keep func(mf *dto.MetricFamily, m *dto.Metric) bool) []*dto.MetricFamily {
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			if keep(mf, m) {
+				metrics = append(metrics, m)
+			}
+		}
+		mf.Metric = metrics
+		if len(mf.Metric) > 0 {
+			kept = append(kept, mf)
+		}
+	}
+	return kept
+}
+
+func (p provinceGatherer) match(m *dto.Metric) bool {
+	for _, label := range m.GetLabel() {
+		if label.GetName() == "Provincia" {
+			return containsFold(p.provinces, label.GetValue())
+		}
+	}
+	return true
+}
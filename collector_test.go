@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxSampleAge(t *testing.T) {
+	// the test prices are old, add a recent one, in the local time of the
+	// reports.
+	recent := time.Now().In(reportLocation).Add(-time.Minute).Truncate(time.Second)
+	prices := testPricesCSV + fmt.Sprintf("2;Gasolio;1.899;1;%s\n", recent.Format("02/01/2006 15:04:05"))
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{UseReportTimestamp: true, MaxSampleAge: time.Hour})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.oldSamples); got != 3 {
+		t.Errorf("got %v old samples, want 3", got)
+	}
+
+	families, err := e.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "osservatorio_carburanti_price" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			id := labels["IDImpianto"]
+			if id == "2" && labels["Carburante"] == "Gasolio" {
+				if got := m.GetTimestampMs(); got != recent.UnixMilli() {
+					t.Errorf("got timestamp %d for the recent price, want %d", got, recent.UnixMilli())
+				}
+			} else if m.TimestampMs != nil {
+				t.Errorf("got timestamp %d for an old price of station %s, want none", m.GetTimestampMs(), id)
+			}
+		}
+	}
+}
+
+func TestDropOrphans(t *testing.T) {
+	records := []*Record{
+		{IDImpianto: 1, Carburante: "Benzina", Prezzo: 1.899, SelfService: true},
+		{IDImpianto: 1, Carburante: "Gasolio", Prezzo: 1.799},
+		{IDImpianto: 2, Carburante: "Benzina", Prezzo: 1.999},
+		// station 3 has no metadata.
+		{IDImpianto: 3, Carburante: "Benzina", Prezzo: 1.899, SelfService: true},
+	}
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM"},
+		2: {ID: 2, Provincia: "MI"},
+	}
+	for _, tt := range []struct {
+		dropOrphans bool
+		want        int
+	}{
+		{false, 4},
+		{true, 3},
+	} {
+		e, err := NewExporter(Config{DropOrphans: tt.dropOrphans})
+		if err != nil {
+			t.Fatalf("NewExporter failed: %v", err)
+		}
+		e.store.Update(records, stations, time.Now())
+		e.Collect()
+		got, err := testutil.GatherAndCount(e.registry, "osservatorio_carburanti_price")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("got %d prices with DropOrphans=%t, want %d", got, tt.dropOrphans, tt.want)
+		}
+	}
+}
+
+func TestSeriesCountWithoutMatches(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{Filter: Filter{Provinces: []string{"XX"}}})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := gaugeValue(t, e.registry, "osservatorio_carburanti_series_count"); got != 0 {
+		t.Errorf("got a series count of %v, want 0", got)
+	}
+	if got := gaugeValue(t, e.registry, "osservatorio_carburanti_active"); got != 1 {
+		t.Errorf("got active %v, want 1", got)
+	}
+}
+
+func TestSplitFuelMetrics(t *testing.T) {
+	prices := testPricesCSV + "2;Metano;1.399;0;12/10/2023 09:00:00\n"
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{SplitFuelMetrics: true})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	body := scrape(t, e.Handler(), "/metrics").Body.String()
+	for _, want := range []string{
+		`osservatorio_carburanti_price_gas{Bandiera="Q8",Carburante="Metano",`,
+		`osservatorio_carburanti_price_liquid{Bandiera="Eni",Carburante="Benzina",`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("series %s not found", want)
+		}
+	}
+	for _, unwant := range []string{
+		`osservatorio_carburanti_price{`,
+		`osservatorio_carburanti_price_gas{Bandiera="Eni",Carburante="Benzina",`,
+		`osservatorio_carburanti_price_liquid{Bandiera="Q8",Carburante="Metano",`,
+	} {
+		if strings.Contains(body, unwant) {
+			t.Errorf("unexpected series %s", unwant)
+		}
+	}
+}
+
+func TestDroppedSeriesAreRemoved(t *testing.T) {
+	var prices, stations atomic.Value
+	prices.Store(testPricesCSV)
+	stations.Store(testStationsCSV)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, prices.Load().(string))
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, stations.Load().(string))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+
+	// station 1 stops selling Gasolio, station 2 disappears.
+	prices.Store(strings.Join(strings.SplitAfter(testPricesCSV, "\n")[:3], ""))
+	stations.Store(strings.Join(strings.SplitAfter(testStationsCSV, "\n")[:3], ""))
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	want := `
+# HELP osservatorio_carburanti_price Fuel prices from Osservatorio Carburanti from MISE
+# TYPE osservatorio_carburanti_price gauge
+osservatorio_carburanti_price{Bandiera="Eni",Carburante="Benzina",Comune="ROMA",IDImpianto="1",Nome="Eni Roma",Provincia="RM",SelfService="true",Tipo="Stradale"} 1.899
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(want), "osservatorio_carburanti_price"); err != nil {
+		t.Error(err)
+	}
+	if got, err := testutil.GatherAndCount(e.registry, "osservatorio_carburanti_station_info"); err != nil || got != 1 {
+		t.Errorf("got %d station info series, %v, want 1", got, err)
+	}
+}
+
+func TestPricePrecision(t *testing.T) {
+	prices := strings.Replace(testPricesCSV, "1;Gasolio;1.799;", "1;Gasolio;1.7994;", 1)
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{PricePrecision: 3})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.unexpectedPrecision); got != 1 {
+		t.Errorf("got %v prices with an unexpected precision, want 1", got)
+	}
+	want := `
+# HELP osservatorio_carburanti_price Fuel prices from Osservatorio Carburanti from MISE
+# TYPE osservatorio_carburanti_price gauge
+osservatorio_carburanti_price{Bandiera="Eni",Carburante="Benzina",Comune="ROMA",IDImpianto="1",Nome="Eni Roma",Provincia="RM",SelfService="true",Tipo="Stradale"} 1.899
+osservatorio_carburanti_price{Bandiera="Eni",Carburante="Gasolio",Comune="ROMA",IDImpianto="1",Nome="Eni Roma",Provincia="RM",SelfService="false",Tipo="Stradale"} 1.799
+osservatorio_carburanti_price{Bandiera="Q8",Carburante="Benzina",Comune="MILANO",IDImpianto="2",Nome="Q8 Milano",Provincia="MI",SelfService="false",Tipo="Autostradale"} 1.999
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(want), "osservatorio_carburanti_price"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPriceVsReference(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	// fuel types are matched case-insensitively
+	e := newTestExporter(t, srv, Config{ReferencePrices: map[string]float64{"benzina": 1.8}})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	benzina1, benzina2, reference := 1.899, 1.999, 1.8
+	want := fmt.Sprintf(`
+# HELP osservatorio_carburanti_price_vs_reference Price minus the configured reference price of the fuel type
+# TYPE osservatorio_carburanti_price_vs_reference gauge
+osservatorio_carburanti_price_vs_reference{Carburante="Benzina",IDImpianto="1",SelfService="true"} %v
+osservatorio_carburanti_price_vs_reference{Carburante="Benzina",IDImpianto="2",SelfService="false"} %v
+`, benzina1-reference, benzina2-reference)
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(want), "osservatorio_carburanti_price_vs_reference"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCarburantiCollector(t *testing.T) {
+	var downloads atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{MinRefreshInterval: time.Hour})
+	c := e.NewCarburantiCollector()
+
+	// the data is downloaded by the first collection, without a refresh.
+	for i := 0; i < 2; i++ {
+		if got := testutil.CollectAndCount(c, "osservatorio_carburanti_price"); got != 3 {
+			t.Errorf("collection %d: got %d series, want 3", i, got)
+		}
+	}
+	if got := downloads.Load(); got != 1 {
+		t.Errorf("got %d downloads after two collections of fresh data, want 1", got)
+	}
+}
+
+func TestRefreshOnScrapeWithPushgateway(t *testing.T) {
+	// pushing gathers the registry, including the CarburantiCollector,
+	// from within a refresh.
+	var pushes atomic.Int32
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		pushes.Add(1)
+	}))
+	defer pushgateway.Close()
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{RefreshOnScrape: true, MinRefreshInterval: time.Hour, Pushgateway: pushgateway.URL, PushgatewayJob: "test"})
+	done := make(chan int)
+	go func() { done <- scrape(t, e.Handler(), "/metrics").Code }()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Errorf("got status %d, want %d", code, http.StatusOK)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape deadlocked pushing to the Pushgateway")
+	}
+	if got := pushes.Load(); got != 1 {
+		t.Errorf("got %d pushes, want 1", got)
+	}
+}
+
+func TestAggregatesOnScrape(t *testing.T) {
+	var downloads atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{AggregatesOnScrape: true})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	want := `
+# HELP osservatorio_carburanti_price_min Minimum price, per province and fuel type
+# TYPE osservatorio_carburanti_price_min gauge
+osservatorio_carburanti_price_min{Carburante="Benzina",Provincia="MI"} 1.999
+osservatorio_carburanti_price_min{Carburante="Benzina",Provincia="RM"} 1.899
+osservatorio_carburanti_price_min{Carburante="Gasolio",Provincia="RM"} 1.799
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(want), "osservatorio_carburanti_price_min"); err != nil {
+		t.Error(err)
+	}
+
+	// change the snapshot without downloading anything.
+	snap := e.store.Snapshot()
+	e.store.Update([]*Record{{IDImpianto: 2, Carburante: "Benzina", Prezzo: 1.5}}, snap.Stations, snap.StationsUpdated)
+	want = `
+# HELP osservatorio_carburanti_price_min Minimum price, per province and fuel type
+# TYPE osservatorio_carburanti_price_min gauge
+osservatorio_carburanti_price_min{Carburante="Benzina",Provincia="MI"} 1.5
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(want), "osservatorio_carburanti_price_min"); err != nil {
+		t.Error(err)
+	}
+	if got := downloads.Load(); got != 1 {
+		t.Errorf("got %d downloads, want 1", got)
+	}
+}
+
+func TestPriceAge(t *testing.T) {
+	const layout = "02/01/2006 15:04:05"
+	// the report times are in Italian local time.
+	now := time.Now().In(reportLocation)
+	prices := `Estrazione del 2023-10-12
+idImpianto;descCarburante;prezzo;isSelf;dtComu
+` + fmt.Sprintf("1;Benzina;1.899;1;%s\n", now.Add(-time.Hour).Format(layout)) +
+		fmt.Sprintf("2;Gasolio;1.799;0;%s\n", now.Add(-5*time.Minute).Format(layout)) +
+		// in the future
+		fmt.Sprintf("1;Gasolio;1.799;0;%s\n", now.Add(time.Hour).Format(layout)) +
+		// without a report time
+		"2;Benzina;1.999;0;not a time\n"
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	families, err := e.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ages := make(map[string]float64)
+	for _, mf := range families {
+		if mf.GetName() != "osservatorio_carburanti_price_age_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			ages[labels["IDImpianto"]+"/"+labels["Carburante"]] = m.GetGauge().GetValue()
+		}
+	}
+	if len(ages) != 3 {
+		t.Fatalf("got ages %v, want 3", ages)
+	}
+	if age := ages["1/Benzina"]; age < 3600 || age > 3600+60 {
+		t.Errorf("got an age of %vs for a price reported an hour ago, want about 3600", age)
+	}
+	if age := ages["2/Gasolio"]; age < 5*60 || age > 6*60 {
+		t.Errorf("got an age of %vs for a price reported 5 minutes ago, want about 300", age)
+	}
+	if age := ages["1/Gasolio"]; age != 0 {
+		t.Errorf("got an age of %vs for a price reported in the future, want 0", age)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// deltaTracker remembers, per client token, the series returned to the
+// client by its last delta scrape. Tokens that are not seen for the TTL of
+// the cache, or that are the least recently seen when too many tokens are
+// tracked, are forgotten, and their next scrape returns all the series.
+type deltaTracker struct {
+	// mu serializes the scrapes, so that concurrent ones with the same
+	// token do not miss or repeat changes.
+	mu    sync.Mutex
+	cache *Cache[map[string]string]
+}
+
+// newDeltaTracker returns a deltaTracker forgetting the tokens not seen for
+// `ttl`, and tracking at most `maxTokens` of them.
+func newDeltaTracker(ttl time.Duration, maxTokens int) *deltaTracker {
+	cache := NewCache[map[string]string](ttl)
+	cache.MaxEntries = maxTokens
+	return &deltaTracker{cache: cache}
+}
+
+// seriesKey returns a key identifying the series of `m` in `mf`.
+func seriesKey(mf *dto.MetricFamily, m *dto.Metric) string {
+	parts := []string{mf.GetName()}
+	for _, lp := range m.GetLabel() {
+		parts = append(parts, lp.GetName(), lp.GetValue())
+	}
+	return strings.Join(parts, "\xff")
+}
+
+// gather gathers the metrics from `g`, keeping only the series that are new
+// or changed since the last call with the same token. Series that are gone
+// are not reported. The token's state is only updated if gathering succeeds,
+// since the metrics are not served otherwise.
+func (d *deltaTracker) gather(g prometheus.Gatherer, token string) ([]*dto.MetricFamily, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var last map[string]string
+	if values, ok := d.cache.Get(token); ok {
+		last = values[0]
+	}
+	mfs, err := g.Gather()
+	current := make(map[string]string)
+	kept := filterFamilies(mfs, func(mf *dto.MetricFamily, m *dto.Metric) bool {
+		k := seriesKey(mf, m)
+		// the labels are part of the key already, and the value, the
+		// timestamp included, is the rest.
+		v := m.String()
+		current[k] = v
+		prev, ok := last[k]
+		return !ok || prev != v
+	})
+	if err == nil {
+		d.cache.Set(token, current)
+	}
+	return kept, err
+}
+
+// DeltaHandler returns an http.Handler serving only the series that changed
+// since the last scrape by the same client, identified by the `token` query
+// parameter. The first scrape of a token returns all the series.
+func (e *Exporter) DeltaHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "missing token", http.StatusBadRequest)
+			return
+		}
+		g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return e.delta.gather(e.registry, token)
+		})
+		e.handlerFor(g).ServeHTTP(w, r)
+	})
+}
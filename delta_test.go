@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deltaSeries returns the values of the series of `name` returned by a delta
+// gather for `token`, by `id` label.
+func deltaSeries(t *testing.T, d *deltaTracker, g prometheus.Gatherer, token string) map[string]float64 {
+	t.Helper()
+	mfs, err := d.gather(g, token)
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	ret := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			ret[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	return ret
+}
+
+func TestDeltaGather(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_price"}, []string{"id"})
+	reg.MustRegister(g)
+	g.WithLabelValues("1").Set(1.899)
+	g.WithLabelValues("2").Set(1.999)
+	d := newDeltaTracker(time.Hour, 10)
+
+	want := map[string]float64{"1": 1.899, "2": 1.999}
+	if got := deltaSeries(t, d, reg, "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("first scrape: got %v, want %v", got, want)
+	}
+	g.WithLabelValues("2").Set(1.949)
+	g.WithLabelValues("3").Set(1.799)
+	want = map[string]float64{"2": 1.949, "3": 1.799}
+	if got := deltaSeries(t, d, reg, "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("second scrape: got %v, want only the changed series %v", got, want)
+	}
+	if got := deltaSeries(t, d, reg, "a"); len(got) != 0 {
+		t.Errorf("scrape without changes: got %v, want none", got)
+	}
+	// every token has its own state.
+	want = map[string]float64{"1": 1.899, "2": 1.949, "3": 1.799}
+	if got := deltaSeries(t, d, reg, "b"); !reflect.DeepEqual(got, want) {
+		t.Errorf("first scrape of another token: got %v, want %v", got, want)
+	}
+}
+
+func TestDeltaMaxTokens(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_price"}, []string{"id"})
+	reg.MustRegister(g)
+	g.WithLabelValues("1").Set(1.899)
+	d := newDeltaTracker(time.Hour, 2)
+	now := time.Now()
+	for i, token := range []string{"a", "b", "c"} {
+		d.cache.now = func() time.Time { return now.Add(time.Duration(i) * time.Second) }
+		deltaSeries(t, d, reg, token)
+	}
+	var tokens []string
+	for token := range d.cache.entries {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	if want := []string{"b", "c"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("got tokens %v, want %v", tokens, want)
+	}
+	// a forgotten token gets all the series again.
+	if got := deltaSeries(t, d, reg, "a"); len(got) != 1 {
+		t.Errorf("got %v for a forgotten token, want all the series", got)
+	}
+}
+
+func TestDeltaHandler(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	h := e.DeltaHandler()
+	if w := scrape(t, h, "/metrics/delta"); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d without a token, want %d", w.Code, http.StatusBadRequest)
+	}
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	const price = "osservatorio_carburanti_price{"
+	w := scrape(t, h, "/metrics/delta?token=a")
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := strings.Count(w.Body.String(), price); got != 3 {
+		t.Errorf("got %d prices in the first scrape, want 3", got)
+	}
+	if body := scrape(t, h, "/metrics/delta?token=a").Body.String(); strings.Contains(body, price) {
+		t.Errorf("got unchanged prices in the second scrape:\n%s", body)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// diskCacheFile saves a copy of a downloaded file in the cache directory, so
+// that the exporter can warm up from it on the next start, see WarmUp. The
+// copy is written to a temporary file, and only replaces the cached one once
+// committed, i.e. once the download was parsed successfully. A nil
+// diskCacheFile does nothing.
+type diskCacheFile struct {
+	f    *os.File
+	path string
+}
+
+// diskCachePath returns the path of the cached copy of `source`.
+func (e *Exporter) diskCachePath(source string) string {
+	return filepath.Join(e.cfg.CacheDir, source+".csv")
+}
+
+// newDiskCacheFile returns a diskCacheFile for `source`, or nil if there is
+// no cache directory, caching is disabled, or the file cannot be created.
+// Failing to cache is not fatal, it only makes the next start slower.
+func (e *Exporter) newDiskCacheFile(source string) *diskCacheFile {
+	if e.cfg.CacheDir == "" || e.noDiskCache {
+		return nil
+	}
+	path := e.diskCachePath(source)
+	f, err := os.CreateTemp(e.cfg.CacheDir, source+".*.tmp")
+	if err != nil {
+		log.Printf("Failed to create cache file for %s: %v", source, err)
+		return nil
+	}
+	return &diskCacheFile{f: f, path: path}
+}
+
+// tee returns a reader copying to the cache file what is read from `r`.
+func (c *diskCacheFile) tee(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return io.TeeReader(r, c.f)
+}
+
+// commit replaces the cached file with the new copy.
+func (c *diskCacheFile) commit() {
+	if c == nil {
+		return
+	}
+	if err := c.f.Close(); err != nil {
+		log.Printf("Failed to write cache file %q: %v", c.path, err)
+		os.Remove(c.f.Name())
+		return
+	}
+	if err := os.Rename(c.f.Name(), c.path); err != nil {
+		log.Printf("Failed to replace cache file %q: %v", c.path, err)
+		os.Remove(c.f.Name())
+	}
+}
+
+// abort discards the new copy, keeping the cached file.
+func (c *diskCacheFile) abort() {
+	if c == nil {
+		return
+	}
+	c.f.Close()
+	os.Remove(c.f.Name())
+}
+
+// WarmUp loads the prices and stations saved in the cache directory by a
+// previous run, if any, so that metrics are served right away instead of
+// after the first refresh. It does nothing if there is no cache directory.
+func (e *Exporter) WarmUp() error {
+	if e.cfg.CacheDir == "" {
+		return nil
+	}
+	pf, err := os.Open(e.diskCachePath(sourcePrices))
+	if err != nil {
+		return fmt.Errorf("failed to open cached prices: %w", err)
+	}
+	defer pf.Close()
+	records, _, err := parseRecords(pf)
+	if err != nil {
+		return fmt.Errorf("failed to parse cached prices: %w", err)
+	}
+	records, _ = validateRecords(records, e.cfg.Validators)
+	records = dedupeLatest(records)
+	sf, err := os.Open(e.diskCachePath(sourceStations))
+	if err != nil {
+		return fmt.Errorf("failed to open cached stations: %w", err)
+	}
+	defer sf.Close()
+	info, err := sf.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat cached stations: %w", err)
+	}
+	stations, _, err := parseStations(sf, e.cfg.StationsSchema)
+	if err != nil {
+		return fmt.Errorf("failed to parse cached stations: %w", err)
+	}
+	// the stations are as old as the cached file.
+	e.setStations(stations, info.ModTime())
+	records, stations, _ = filterStations(records, stations, &e.cfg.Filter)
+	e.updateStore(records, stations, info.ModTime())
+	e.Collect()
+	return nil
+}
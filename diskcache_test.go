@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// seedDiskCache writes `prices` and `stations` to a new cache directory, as
+// saved by a previous run, and returns its path.
+func seedDiskCache(t *testing.T, prices, stations string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range map[string]string{sourcePrices: prices, sourceStations: stations} {
+		if err := os.WriteFile(filepath.Join(dir, name+".csv"), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestWarmUpFromDiskCache(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	dir := seedDiskCache(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{CacheDir: dir})
+	if err := e.WarmUp(); err != nil {
+		t.Fatalf("WarmUp failed: %v", err)
+	}
+	body := scrape(t, e.Handler(), "/metrics").Body.String()
+	if got := strings.Count(body, "osservatorio_carburanti_price{"); got != 3 {
+		t.Errorf("got %d prices from the cache, want 3", got)
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("got %d requests, want none", got)
+	}
+}
+
+func TestStartWarmCache(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// without cached data, the failed initial refresh is an error.
+	e := newTestExporter(t, srv, Config{Interval: time.Hour, RetryBaseDelay: time.Millisecond})
+	if err := e.Start(ctx, 2); err == nil {
+		t.Fatal("Start succeeded without any data to serve")
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want 2 initial refresh attempts", got)
+	}
+
+	// the cached data is served right away, and refreshed in the
+	// background.
+	requests.Store(0)
+	e = newTestExporter(t, srv, Config{Interval: time.Hour, CacheDir: seedDiskCache(t, testPricesCSV, testStationsCSV)})
+	if err := e.WarmUp(); err != nil {
+		t.Fatalf("WarmUp failed: %v", err)
+	}
+	if err := e.Start(ctx, 2); err != nil {
+		t.Fatalf("Start failed with cached data: %v", err)
+	}
+	body := scrape(t, e.Handler(), "/metrics").Body.String()
+	if got := strings.Count(body, "osservatorio_carburanti_price{"); got != 3 {
+		t.Errorf("got %d prices from the cache, want 3", got)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for requests.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the data was not refreshed in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWarmUpDedupesPrices(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	prices := testPricesCSV + "1;Benzina;1.849;1;12/10/2023 10:00:00\n"
+	e := newTestExporter(t, srv, Config{CacheDir: seedDiskCache(t, prices, testStationsCSV)})
+	if err := e.WarmUp(); err != nil {
+		t.Fatalf("WarmUp failed: %v", err)
+	}
+	records := e.store.Snapshot().Records
+	if len(records) != 3 {
+		t.Fatalf("got %d records from the cache, want 3", len(records))
+	}
+	for _, record := range records {
+		if record.IDImpianto == 1 && record.Carburante == "Benzina" && record.Prezzo != 1.849 {
+			t.Errorf("got price %v, want the newer 1.849", record.Prezzo)
+		}
+	}
+}
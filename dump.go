@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// DumpRecords fetches prices and stations once, and writes to `w` the first
+// `n` records that would be exported, joined with their station metadata, as
+// a table: the ones matching the Filter and, with DropOrphans, with station
+// metadata. The downloaded files are not saved to CacheDir, so that a dump
+// does not change what the next start warms up from.
+func (e *Exporter) DumpRecords(ctx context.Context, w io.Writer, n int) error {
+	e.noDiskCache = true
+	defer func() { e.noDiskCache = false }()
+	records, err := e.fetchPrices(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch prices: %w", err)
+	}
+	stations, err := e.fetchStations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch stations: %w", err)
+	}
+	records, stations, _ = filterStations(records, stations, &e.cfg.Filter)
+	records = priceRecords(Snapshot{Records: records, Stations: stations}, e.cfg.DropOrphans)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IDImpianto\tCarburante\tPrezzo\tSelfService\tDataComunicazione\tNome\tBandiera\tTipo\tComune\tProvincia")
+	for i, record := range records {
+		if i >= n {
+			break
+		}
+		station := stations[record.IDImpianto]
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			record.IDImpianto,
+			record.Carburante,
+			strconv.FormatFloat(record.Prezzo, 'f', -1, 64),
+			record.SelfService,
+			record.DataComunicazione.Format(time.DateTime),
+			station.Nome,
+			station.Bandiera,
+			station.Tipo,
+			station.Comune,
+			station.Provincia,
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDumpRecords(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	var b strings.Builder
+	if err := e.DumpRecords(context.Background(), &b, 10); err != nil {
+		t.Fatalf("DumpRecords failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want a header and 3 records:\n%s", len(lines), b.String())
+	}
+	// the columns are aligned with spaces, compare the fields.
+	got := make(map[string]bool)
+	for _, line := range lines[1:] {
+		got[strings.Join(strings.Fields(line), " ")] = true
+	}
+	for _, want := range []string{
+		"1 Benzina 1.899 true 2023-10-12 08:00:00 Eni Roma Eni Stradale ROMA RM",
+		"1 Gasolio 1.799 false 2023-10-12 08:00:00 Eni Roma Eni Stradale ROMA RM",
+		"2 Benzina 1.999 false 2023-10-12 09:00:00 Q8 Milano Q8 Autostradale MILANO MI",
+	} {
+		if !got[want] {
+			t.Errorf("record %q not found in:\n%s", want, b.String())
+		}
+	}
+
+	b.Reset()
+	if err := e.DumpRecords(context.Background(), &b, 1); err != nil {
+		t.Fatalf("DumpRecords failed: %v", err)
+	}
+	if got := strings.Count(b.String(), "\n"); got != 2 {
+		t.Errorf("got %d lines, want a header and 1 record:\n%s", got, b.String())
+	}
+}
+
+func TestDumpRecordsExported(t *testing.T) {
+	// station 3 has no metadata.
+	prices := testPricesCSV + "3;Benzina;1.849;1;12/10/2023 08:00:00\n"
+	srv := newTestServer(t, prices, testStationsCSV)
+	dir := t.TempDir()
+	e := newTestExporter(t, srv, Config{
+		Filter:      Filter{Carburanti: []string{"Benzina"}},
+		DropOrphans: true,
+		CacheDir:    dir,
+	})
+	var b strings.Builder
+	if err := e.DumpRecords(context.Background(), &b, 10); err != nil {
+		t.Fatalf("DumpRecords failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and the 2 exported records:\n%s", len(lines), b.String())
+	}
+	for _, line := range lines[1:] {
+		if fields := strings.Fields(line); fields[1] != "Benzina" || fields[0] == "3" {
+			t.Errorf("got record %q, want only Benzina with station metadata", line)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("got %v, %v in the cache directory, want it empty", entries, err)
+	}
+}
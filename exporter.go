@@ -0,0 +1,859 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Config is the configuration of an Exporter.
+type Config struct {
+	// PricesURL and StationsURL are where the prices and stations CSV files
+	// are fetched from. They default to the MIMIT URLs.
+	PricesURL   string
+	StationsURL string
+	// PricesFile and StationsFile, if not empty, are local files to read the
+	// prices and stations CSV files from, instead of fetching them.
+	PricesFile   string
+	StationsFile string
+	// StationsSchema is the layout of the stations file, see
+	// stationsSchemas. Defaults to the current one.
+	StationsSchema StationsSchema
+	// Validators are applied to every parsed price record, records failing
+	// any of them are dropped.
+	Validators []NamedValidator
+	// CacheTTL is how long the price records are cached after they are
+	// first seen, see fetchPrices.
+	CacheTTL time.Duration
+	// UseReportTimestamp exports prices with their report time
+	// (DataComunicazione) as sample timestamp. Reports older than
+	// MaxSampleAge are exported with the current time instead.
+	UseReportTimestamp bool
+	MaxSampleAge       time.Duration
+	// DropOrphans skips exporting the prices of stations without metadata,
+	// instead of exporting them with empty station labels.
+	DropOrphans bool
+	// Interval is the time between two refreshes in Run.
+	Interval time.Duration
+	// StationsInterval is the minimum time between two downloads of the
+	// stations, which change far less often than the prices: refreshes in
+	// between reuse the last downloaded ones. If zero, the stations are
+	// downloaded on every refresh.
+	StationsInterval time.Duration
+	// RefreshOnScrape makes the metrics handler refresh the data, at most
+	// every MinRefreshInterval, instead of relying on Run. The prices are
+	// then exported by a CarburantiCollector, so that gathering the
+	// registry by other means refreshes them as well.
+	RefreshOnScrape    bool
+	MinRefreshInterval time.Duration
+	// AggregatesOnScrape computes the aggregate metrics from the current
+	// snapshot when they are scraped, instead of after each refresh.
+	AggregatesOnScrape bool
+	// Pushgateway, if not empty, is the URL of a Pushgateway where metrics
+	// are pushed to after each refresh, using PushgatewayJob as job name.
+	Pushgateway    string
+	PushgatewayJob string
+	// DecimalSeparator is used to format prices in the API and CSV export.
+	// Defaults to ".".
+	DecimalSeparator string
+	// InfluxURL, if not empty, is an InfluxDB line protocol write URL where
+	// prices are pushed to after each refresh.
+	InfluxURL string
+	// MaxRetryAfter caps how long to wait before retrying a download
+	// rejected with 429 Too Many Requests. Defaults to 5 minutes.
+	MaxRetryAfter time.Duration
+	// ActiveOnly excludes from the station metadata the stations without
+	// any price reported in the last StaleAfter.
+	ActiveOnly bool
+	StaleAfter time.Duration
+	// ASCIILabels folds the price label values to ASCII, removing accents.
+	// The original values are still exported by the station info metric.
+	ASCIILabels bool
+	// SplitFuelMetrics exports the prices of liquid and gaseous fuels, that
+	// are sold in different units, as separate metrics, see fuelCategory.
+	SplitFuelMetrics bool
+	// CacheDir, if not empty, is a directory where the downloaded files are
+	// saved, to warm up from them on the next start, see WarmUp.
+	CacheDir string
+	// GeoPrecision, if greater than zero, is the number of decimals the
+	// coordinates of the station info metric are rounded to.
+	GeoPrecision int
+	// PricePrecision, if greater than zero, is the number of decimals the
+	// prices are rounded to when exported, whatever their precision in the
+	// prices file. Prices with a different precision are counted.
+	PricePrecision int
+	// MinSamples is the minimum number of prices of a fuel type in a
+	// province to export statistics about them.
+	MinSamples int
+	// APICacheTTL, if greater than zero, is how long API responses are
+	// cached, to absorb bursts of identical requests.
+	APICacheTTL time.Duration
+	// RegionCheapest exports the lowest price of each fuel type per region.
+	RegionCheapest bool
+	// ForceHTTP1 disables HTTP/2 when downloading the data, to work around
+	// servers with a broken HTTP/2 implementation.
+	ForceHTTP1 bool
+	// DNSServer, if not empty, is the DNS server, as host:port, used to
+	// resolve the download hosts instead of the system's resolvers.
+	DNSServer string
+	// PinnedKeys, if not empty, are the SHA-256 pins of the public keys
+	// accepted for the download hosts, see parsePin. Connections to hosts
+	// whose certificates match none of them are rejected.
+	PinnedKeys [][sha256.Size]byte
+	// ThroughputDecay is the weight, between 0 and 1, of the latest refresh
+	// in the moving average of the parse throughput. Defaults to 0.3.
+	ThroughputDecay float64
+	// Filter restricts all the exported data to the stations and the price
+	// records it matches, see filterStations.
+	Filter Filter
+	// HTTPTimeout is the maximum duration of a download. Defaults to 30
+	// seconds.
+	HTTPTimeout time.Duration
+	// RetryAttempts is how many times a download is attempted before giving
+	// up, waiting RetryBaseDelay after the first failure and doubling the
+	// wait after each one. Defaults to 3 attempts and 10 seconds.
+	RetryAttempts  int
+	RetryBaseDelay time.Duration
+	// InstanceLabels are constant labels added to all the metrics, including
+	// the tenants' ones, to tell apart multiple exporters.
+	InstanceLabels prometheus.Labels
+	// HealthMaxAge is how old the last successful refresh can be for
+	// /healthz to report the exporter as healthy. Defaults to 3 hours.
+	HealthMaxAge time.Duration
+	// DeltaTokenTTL is how long the state of a delta scrape client is kept
+	// after its last scrape, see DeltaHandler. Defaults to 1 hour.
+	DeltaTokenTTL time.Duration
+	// DeltaMaxTokens is the maximum number of delta scrape clients whose
+	// state is kept, the least recently seen one is forgotten first.
+	// Defaults to 100.
+	DeltaMaxTokens int
+	// ReferencePrices are prices, by fuel type, that the prices of that fuel
+	// are compared with. Fuel types are matched case-insensitively.
+	ReferencePrices map[string]float64
+	// AuditLogger, if not nil, logs the changes of the stations' metadata
+	// between refreshes, see auditStations.
+	AuditLogger *slog.Logger
+}
+
+// Exporter fetches fuel prices and exports them as Prometheus metrics. Each
+// Exporter has its own registry, so that multiple exporters can live in the
+// same process.
+type Exporter struct {
+	cfg      Config
+	registry *prometheus.Registry
+	// aggregates only has the aggregate metrics, see metrics.aggregates.
+	aggregates *prometheus.Registry
+	metrics    *metrics
+	store      *Store
+	cache      *Cache[Record]
+	// apiCache caches the API responses, see cachedAPI.
+	apiCache *Cache[apiResponse]
+	client   *http.Client
+	// pushClient is used to push the metrics, since the transport of
+	// client is set up for the download hosts, e.g. with PinnedKeys.
+	pushClient *http.Client
+	// noDiskCache disables saving the downloaded files to CacheDir, see
+	// DumpRecords.
+	noDiskCache bool
+	// delta tracks the series served to the delta scrape clients.
+	delta *deltaTracker
+
+	// parseThroughput averages the records parsed per second over the
+	// refreshes.
+	parseThroughput *ewma
+
+	// refreshMu serializes the refreshes, lastRefresh is when the last one
+	// of refreshIfStale completed, and lastRefreshErr its error.
+	refreshMu      sync.Mutex
+	lastRefresh    time.Time
+	lastRefreshErr error
+
+	// maxRefresh is the longest refresh since startup or since the last
+	// reset, see observeRefresh.
+	maxRefreshMu sync.Mutex
+	maxRefresh   time.Duration
+
+	// stations caches the downloaded stations, see getStations.
+	stations stationsCache
+
+	// lastSuccess is when the last successful refresh completed, see
+	// handleHealthz.
+	lastSuccessMu sync.Mutex
+	lastSuccess   time.Time
+}
+
+// NewExporter returns a new Exporter with the given configuration, with all
+// of its metrics registered.
+func NewExporter(cfg Config) (*Exporter, error) {
+	if cfg.PricesURL == "" {
+		cfg.PricesURL = pricesCSVURL
+	}
+	if cfg.StationsURL == "" {
+		cfg.StationsURL = stationsCSVURL
+	}
+	if cfg.StationsSchema == (StationsSchema{}) {
+		cfg.StationsSchema = stationsSchemas[defaultStationsSchema]
+	}
+	if cfg.RetryAttempts == 0 {
+		cfg.RetryAttempts = 3
+	}
+	if cfg.RetryBaseDelay == 0 {
+		cfg.RetryBaseDelay = 10 * time.Second
+	}
+	if cfg.HTTPTimeout == 0 {
+		cfg.HTTPTimeout = 30 * time.Second
+	}
+	if cfg.ThroughputDecay == 0 {
+		cfg.ThroughputDecay = 0.3
+	}
+	if cfg.HealthMaxAge == 0 {
+		cfg.HealthMaxAge = 3 * time.Hour
+	}
+	if cfg.DeltaTokenTTL == 0 {
+		cfg.DeltaTokenTTL = time.Hour
+	}
+	if cfg.DeltaMaxTokens == 0 {
+		cfg.DeltaMaxTokens = 100
+	}
+	if cfg.MaxRetryAfter == 0 {
+		cfg.MaxRetryAfter = 5 * time.Minute
+	}
+	registry := prometheus.NewRegistry()
+	reg := instanceRegisterer(registry, cfg.InstanceLabels)
+	// keep exposing the same Go runtime and process metrics as the default
+	// registry.
+	if err := reg.Register(collectors.NewGoCollector()); err != nil {
+		return nil, fmt.Errorf("failed to register Go collector: %w", err)
+	}
+	if err := reg.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+		return nil, fmt.Errorf("failed to register process collector: %w", err)
+	}
+	m, err := newMetrics(reg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metrics: %w", err)
+	}
+	aggregates := prometheus.NewRegistry()
+	cache := NewCache[Record](cfg.CacheTTL)
+	cache.HitAge = m.cacheHitAge
+	e := Exporter{
+		cfg:             cfg,
+		registry:        registry,
+		aggregates:      aggregates,
+		metrics:         m,
+		store:           NewStore(),
+		cache:           cache,
+		apiCache:        NewCache[apiResponse](cfg.APICacheTTL),
+		delta:           newDeltaTracker(cfg.DeltaTokenTTL, cfg.DeltaMaxTokens),
+		parseThroughput: &ewma{alpha: cfg.ThroughputDecay},
+		client:          newHTTPClient(cfg),
+		pushClient:      &http.Client{Timeout: cfg.HTTPTimeout},
+	}
+	aggregateCollectors := m.aggregates()
+	if cfg.AggregatesOnScrape {
+		// replace the aggregate metrics with a collector computing them.
+		for _, c := range aggregateCollectors {
+			reg.Unregister(c)
+		}
+		collector := e.newAggregatesCollector(aggregateCollectors)
+		if err := reg.Register(collector); err != nil {
+			return nil, fmt.Errorf("failed to register aggregates collector: %w", err)
+		}
+		aggregateCollectors = []prometheus.Collector{collector}
+	}
+	aggReg := instanceRegisterer(aggregates, cfg.InstanceLabels)
+	for _, c := range aggregateCollectors {
+		if err := aggReg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register aggregate metric: %w", err)
+		}
+	}
+	// the price metric is already in the catalog, whichever collector
+	// exports it.
+	var prices prometheus.Collector = e.newPriceCollector(nil)
+	if cfg.RefreshOnScrape {
+		prices = e.NewCarburantiCollector()
+	}
+	if cfg.SplitFuelMetrics {
+		m.catalog.remove("osservatorio_carburanti_price")
+		for _, category := range fuelCategories {
+			m.catalog.add(fuelCategoryMetric(category), priceHelp+", "+category+" fuels", "gauge", priceLabels)
+		}
+	}
+	if err := reg.Register(prices); err != nil {
+		return nil, fmt.Errorf("failed to register price metric: %w", err)
+	}
+	for _, c := range e.snapshotCollectors() {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register per-station metric: %w", err)
+		}
+	}
+	stationsAge := m.catalog.gaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "osservatorio_carburanti_stations_cache_age_seconds",
+			Help: "Time since the stations were last successfully fetched",
+		},
+		func() float64 {
+			updated := e.store.Snapshot().StationsUpdated
+			if updated.IsZero() {
+				return 0
+			}
+			return time.Since(updated).Seconds()
+		},
+	)
+	if err := reg.Register(stationsAge); err != nil {
+		return nil, fmt.Errorf("failed to register stations cache age metric: %w", err)
+	}
+	if err := registerSeriesMetrics(reg, e.newPriceCollector(nil), m.catalog); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// instanceRegisterer returns a Registerer adding `labels` to all the metrics
+// registered on `registry`, or `registry` itself if there are none.
+func instanceRegisterer(registry *prometheus.Registry, labels prometheus.Labels) prometheus.Registerer {
+	if len(labels) == 0 {
+		return registry
+	}
+	return prometheus.WrapRegistererWith(labels, registry)
+}
+
+// newPriceCollector returns a priceCollector exporting the prices in the
+// store that match `filter`, or all of them if `filter` is nil.
+func (e *Exporter) newPriceCollector(filter *Filter) *priceCollector {
+	var categoryDescs map[string]*prometheus.Desc
+	if e.cfg.SplitFuelMetrics {
+		categoryDescs = make(map[string]*prometheus.Desc)
+		for _, category := range fuelCategories {
+			categoryDescs[category] = prometheus.NewDesc(fuelCategoryMetric(category), priceHelp+", "+category+" fuels", priceLabels, nil)
+		}
+	}
+	return &priceCollector{
+		categoryDescs:      categoryDescs,
+		desc:               prometheus.NewDesc("osservatorio_carburanti_price", priceHelp, priceLabels, nil),
+		store:              e.store,
+		filter:             filter,
+		useReportTimestamp: e.cfg.UseReportTimestamp,
+		maxAge:             e.cfg.MaxSampleAge,
+		dropOrphans:        e.cfg.DropOrphans,
+		asciiLabels:        e.cfg.ASCIILabels,
+		pricePrecision:     e.cfg.PricePrecision,
+	}
+}
+
+// filterProvinceHeader is the request header of the provinces to filter the
+// metrics by, for proxies that strip the query string. See Handler.
+const filterProvinceHeader = "X-Filter-Province"
+
+// Handler returns an http.Handler serving the metrics of this exporter. The
+// metrics with a Provincia label can be limited to some provinces with a
+// comma-separated list in the `provincia` query parameter or, if it is not
+// set, in the X-Filter-Province header.
+func (e *Exporter) Handler() http.Handler {
+	all := e.handlerFor(e.registry)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter := r.URL.Query().Get("provincia")
+		if filter == "" {
+			filter = r.Header.Get(filterProvinceHeader)
+		}
+		provinces := splitList(filter)
+		if len(provinces) == 0 {
+			all.ServeHTTP(w, r)
+			return
+		}
+		e.handlerFor(provinceGatherer{g: e.registry, provinces: provinces}).ServeHTTP(w, r)
+	})
+}
+
+// AggregatesHandler returns an http.Handler serving only the aggregate
+// metrics of this exporter, without the per-station ones.
+func (e *Exporter) AggregatesHandler() http.Handler {
+	return e.handlerFor(e.aggregates)
+}
+
+// handlerFor returns an http.Handler serving the metrics gathered from `g`,
+// refreshing the data first if RefreshOnScrape is set.
+func (e *Exporter) handlerFor(g prometheus.Gatherer) http.Handler {
+	handler := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	if e.cfg.RefreshOnScrape {
+		handler = refreshOnScrape(handler, e.refreshIfStale)
+	}
+	return handler
+}
+
+// refreshIfStale refreshes the data unless the last successful refresh
+// completed less than MinRefreshInterval ago, so that the refreshes of Run
+// and InitialRefresh count as well. Callers waiting for a refresh in progress
+// share its result, including its error, instead of starting another one. The
+// refresh is detached from the context's cancellation, since it is shared:
+// downloads are bounded by HTTPTimeout.
+func (e *Exporter) refreshIfStale(ctx context.Context) error {
+	start := time.Now()
+	e.refreshMu.Lock()
+	if e.lastRefresh.After(start) {
+		err := e.lastRefreshErr
+		e.refreshMu.Unlock()
+		return err
+	}
+	if time.Since(e.LastSuccess()) < e.cfg.MinRefreshInterval {
+		e.refreshMu.Unlock()
+		return nil
+	}
+	ctx = context.WithoutCancel(ctx)
+	err := e.update(ctx)
+	e.lastRefresh, e.lastRefreshErr = time.Now(), err
+	e.refreshMu.Unlock()
+	if err != nil {
+		return err
+	}
+	e.publish(ctx)
+	return nil
+}
+
+// StartJanitors starts removing the expired items from the caches, every
+// TTL, until the context is cancelled. Caches without a TTL are skipped.
+func (e *Exporter) StartJanitors(ctx context.Context) {
+	if e.cache.TTL > 0 {
+		e.cache.StartJanitor(ctx, e.cache.TTL)
+	}
+	if e.apiCache.TTL > 0 {
+		e.apiCache.StartJanitor(ctx, e.apiCache.TTL)
+	}
+	if e.delta.cache.TTL > 0 {
+		e.delta.cache.StartJanitor(ctx, e.delta.cache.TTL)
+	}
+}
+
+// Run refreshes the data every `Interval` until the context is cancelled,
+// and returns the context's error. Failed refreshes are logged and retried at
+// the next tick. The data is also refreshed right away, unless it was
+// already refreshed less than `Interval` ago, e.g. by InitialRefresh.
+func (e *Exporter) Run(ctx context.Context) error {
+	if e.cfg.Interval <= 0 {
+		return fmt.Errorf("invalid refresh interval %s", e.cfg.Interval)
+	}
+	if time.Since(e.LastSuccess()) >= e.cfg.Interval {
+		_ = e.refresh(ctx)
+	}
+	log.Printf("Refreshing every %s", e.cfg.Interval)
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping the refreshes: %v", ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+			_ = e.refresh(ctx)
+		}
+	}
+}
+
+// refresh refreshes the data like Refresh, logging failures.
+func (e *Exporter) refresh(ctx context.Context) error {
+	err := e.Refresh(ctx)
+	if err != nil {
+		log.Printf("Refresh failed: %v", err)
+	}
+	return err
+}
+
+// InitialRefresh refreshes the data, trying up to `attempts` times with the
+// same backoff as the downloads. It returns the error of the last attempt if
+// all of them fail.
+func (e *Exporter) InitialRefresh(ctx context.Context, attempts int) error {
+	for failures := 1; ; failures++ {
+		err := e.Refresh(ctx)
+		if err == nil {
+			return nil
+		}
+		if failures >= attempts {
+			return err
+		}
+		wait := retryDelay(e.cfg.RetryBaseDelay, failures)
+		log.Printf("Initial refresh failed, retrying in %s: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Start starts the refresh loop of Run in the background, until the context
+// is cancelled. If there is no data to serve yet, e.g. from WarmUp, it first
+// refreshes synchronously with InitialRefresh, and returns its error without
+// starting the loop if it fails.
+func (e *Exporter) Start(ctx context.Context, attempts int) error {
+	if e.ready() != nil {
+		if err := e.InitialRefresh(ctx, attempts); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Serving the cached data, refreshing in the background")
+	}
+	go func() {
+		_ = e.Run(ctx)
+	}()
+	return nil
+}
+
+// Refresh fetches prices and stations, stores them, and updates the metrics.
+// On failure, the previous data is kept.
+func (e *Exporter) Refresh(ctx context.Context) error {
+	e.refreshMu.Lock()
+	err := e.update(ctx)
+	e.refreshMu.Unlock()
+	if err != nil {
+		return err
+	}
+	e.publish(ctx)
+	return nil
+}
+
+// update is Refresh, without publishing the metrics. The caller must hold
+// refreshMu.
+func (e *Exporter) update(ctx context.Context) error {
+	start := time.Now()
+	defer func() { e.observeRefresh(time.Since(start)) }()
+	// TotalAlloc only grows, so the delta is the bytes allocated in between,
+	// regardless of garbage collections.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	records, err := e.fetchPrices(ctx)
+	if err != nil {
+		e.metrics.fetchErrors.WithLabelValues(sourcePrices).Inc()
+		return fmt.Errorf("failed to refresh prices: %w", err)
+	}
+	// refresh the fuel stations' data, if they are old enough.
+	stations, stationsUpdated, err := e.getStations(ctx)
+	if err != nil {
+		e.metrics.fetchErrors.WithLabelValues(sourceStations).Inc()
+		return fmt.Errorf("failed to refresh stations: %w", err)
+	}
+	records, stations, filtered := filterStations(records, stations, &e.cfg.Filter)
+	e.metrics.rows.WithLabelValues(dispositionFiltered).Add(float64(filtered))
+	if e.cfg.ActiveOnly {
+		stations = activeStations(stations, records, time.Now().Add(-e.cfg.StaleAfter))
+	}
+	e.updateStore(records, stations, stationsUpdated)
+	e.countRows(e.store.Snapshot())
+	e.Collect()
+	runtime.ReadMemStats(&after)
+	e.metrics.refreshAlloc.Set(float64(after.TotalAlloc - before.TotalAlloc))
+	e.setLastSuccess(time.Now())
+	return nil
+}
+
+// publish pushes the metrics to the Pushgateway and InfluxDB, if
+// configured. It must be called without holding refreshMu: gathering the
+// registry may call refreshIfStale, see CarburantiCollector.
+func (e *Exporter) publish(ctx context.Context) {
+	if e.cfg.Pushgateway != "" {
+		if err := pushMetrics(e.cfg.Pushgateway, e.cfg.PushgatewayJob, e.registry, e.pushClient); err != nil {
+			// a failed push is not a failed refresh, the data is still
+			// available for scraping.
+			e.metrics.pushErrors.Inc()
+			log.Printf("Failed to push metrics to %q: %v", e.cfg.Pushgateway, err)
+		}
+	}
+	if e.cfg.InfluxURL != "" {
+		if err := e.pushInflux(ctx); err != nil {
+			e.metrics.influxErrors.Inc()
+			log.Printf("Failed to push prices to InfluxDB at %q: %v", e.cfg.InfluxURL, err)
+		}
+	}
+}
+
+// Values of the stations source metric.
+const (
+	stationsSourceFresh = 0
+	stationsSourceCache = 1
+)
+
+// stationsCache holds the last downloaded stations, before any filtering.
+type stationsCache struct {
+	mu       sync.Mutex
+	stations map[int]Station
+	updated  time.Time
+}
+
+// getStations returns the cached stations and when they were downloaded. They
+// are downloaded first if they are missing or older than StationsInterval.
+func (e *Exporter) getStations(ctx context.Context) (map[int]Station, time.Time, error) {
+	e.stations.mu.Lock()
+	defer e.stations.mu.Unlock()
+	if e.stations.stations != nil && time.Since(e.stations.updated) < e.cfg.StationsInterval {
+		e.metrics.stationsSource.Set(stationsSourceCache)
+		return e.stations.stations, e.stations.updated, nil
+	}
+	stations, err := e.fetchStations(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	e.stations.stations, e.stations.updated = stations, time.Now()
+	e.metrics.stationsSource.Set(stationsSourceFresh)
+	return stations, e.stations.updated, nil
+}
+
+// setStations replaces the cached stations, downloaded at `updated`.
+func (e *Exporter) setStations(stations map[int]Station, updated time.Time) {
+	e.stations.mu.Lock()
+	defer e.stations.mu.Unlock()
+	e.stations.stations, e.stations.updated = stations, updated
+}
+
+// updateStore replaces the snapshot in the store, and drops the API responses
+// computed from the previous one. Station changes are audited first, if
+// enabled.
+func (e *Exporter) updateStore(records []*Record, stations map[int]Station, stationsUpdated time.Time) {
+	if e.cfg.AuditLogger != nil {
+		auditStations(e.cfg.AuditLogger, e.store.Snapshot().Stations, stations)
+	}
+	e.store.Update(records, stations, stationsUpdated)
+	e.apiCache.Clear()
+}
+
+// setLastSuccess records the time of a successful refresh.
+func (e *Exporter) setLastSuccess(t time.Time) {
+	e.lastSuccessMu.Lock()
+	defer e.lastSuccessMu.Unlock()
+	e.lastSuccess = t
+	e.metrics.lastSuccess.Set(float64(t.Unix()))
+}
+
+// LastSuccess returns when the last successful refresh completed, or the zero
+// time if none did yet.
+func (e *Exporter) LastSuccess() time.Time {
+	e.lastSuccessMu.Lock()
+	defer e.lastSuccessMu.Unlock()
+	return e.lastSuccess
+}
+
+// observeRefresh records the duration of a refresh, successful or not, in
+// the max refresh duration metric if it is the longest so far.
+func (e *Exporter) observeRefresh(d time.Duration) {
+	e.maxRefreshMu.Lock()
+	defer e.maxRefreshMu.Unlock()
+	if d > e.maxRefresh {
+		e.maxRefresh = d
+		e.metrics.maxRefreshDuration.Set(d.Seconds())
+	}
+}
+
+// resetMaxRefresh resets the max refresh duration metric, so that the next
+// refresh sets it again.
+func (e *Exporter) resetMaxRefresh() {
+	e.maxRefreshMu.Lock()
+	defer e.maxRefreshMu.Unlock()
+	e.maxRefresh = 0
+	e.metrics.maxRefreshDuration.Set(0)
+}
+
+// countRows counts the price rows of a new snapshot that are exported, and
+// the ones that are not because they are orphans or duplicates. Rows dropped
+// while fetching are counted by fetchPrices.
+func (e *Exporter) countRows(snap Snapshot) {
+	exported := priceRecords(snap, e.cfg.DropOrphans)
+	series := len(e.newPriceCollector(nil).series(snap))
+	e.metrics.rows.WithLabelValues(dispositionFiltered).Add(float64(len(snap.Records) - len(exported)))
+	e.metrics.rows.WithLabelValues(dispositionDedup).Add(float64(len(exported) - series))
+	e.metrics.rows.WithLabelValues(dispositionEmitted).Add(float64(series))
+}
+
+// snapshotCollectors returns the collectors of the per-station metrics,
+// other than the prices, see snapshotCollector.
+func (e *Exporter) snapshotCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		&snapshotCollector{desc: e.metrics.priceAge, store: e.store, collect: e.collectPriceAge},
+		&snapshotCollector{desc: e.metrics.stationInfo, store: e.store, collect: e.collectStationInfo},
+		&snapshotCollector{desc: e.metrics.priceVsReference, store: e.store, collect: e.collectPriceVsReference},
+		&snapshotCollector{desc: e.metrics.price7dAvg, store: e.store, collect: e.collectPrice7dAvg},
+	}
+}
+
+// collectPriceAge exports the age of the exported prices. Records with an
+// invalid report time have no age.
+func (e *Exporter) collectPriceAge(snap Snapshot, set func(float64, ...string)) {
+	prices := e.newPriceCollector(nil)
+	now := time.Now()
+	for _, record := range prices.series(snap) {
+		if record.DataComunicazione.IsZero() {
+			continue
+		}
+		set(priceAge(record, now).Seconds(), prices.labelValues(record, snap.Stations)...)
+	}
+}
+
+// collectStationInfo exports the metadata of the stations. Label values are
+// never folded to ASCII here, so that the original ones are always
+// available. Stations snapped to the same coordinates still have their own
+// series, that differ by IDImpianto.
+func (e *Exporter) collectStationInfo(snap Snapshot, set func(float64, ...string)) {
+	for _, station := range snap.Stations {
+		set(1,
+			strconv.Itoa(station.ID),
+			station.Gestore,
+			station.Bandiera,
+			string(station.Tipo),
+			station.Nome,
+			station.Indirizzo,
+			station.Comune,
+			station.Provincia,
+			roundCoordinate(station.Lat, e.cfg.GeoPrecision),
+			roundCoordinate(station.Long, e.cfg.GeoPrecision),
+		)
+	}
+}
+
+// collectPriceVsReference exports the difference between the prices and the
+// reference prices of their fuel type, if any.
+func (e *Exporter) collectPriceVsReference(snap Snapshot, set func(float64, ...string)) {
+	if len(e.cfg.ReferencePrices) == 0 {
+		return
+	}
+	for _, record := range priceRecords(snap, e.cfg.DropOrphans) {
+		reference, ok := referencePrice(e.cfg.ReferencePrices, record.Carburante)
+		if !ok {
+			continue
+		}
+		set(record.Prezzo-reference, strconv.Itoa(record.IDImpianto), record.Carburante, strconv.FormatBool(record.SelfService))
+	}
+}
+
+// collectPrice7dAvg exports the average prices over averageWindow.
+func (e *Exporter) collectPrice7dAvg(_ Snapshot, set func(float64, ...string)) {
+	for k, avg := range e.store.Averages() {
+		set(avg, strconv.Itoa(k.IDImpianto), k.Carburante, strconv.FormatBool(k.SelfService))
+	}
+}
+
+// Collect updates the metrics from the current snapshot in the store.
+func (e *Exporter) Collect() {
+	snap := e.store.Snapshot()
+	if e.cfg.UseReportTimestamp {
+		// prices are exported at scrape time by priceCollector, just
+		// count the samples that will not carry their report time.
+		for _, record := range priceRecords(snap, e.cfg.DropOrphans) {
+			if isOldSample(record, e.cfg.MaxSampleAge) {
+				e.metrics.oldSamples.Inc()
+			}
+		}
+	}
+	if !e.cfg.AggregatesOnScrape {
+		e.collectAggregates(snap)
+	}
+	added, removed := e.store.Churn()
+	e.metrics.stationsAdded.Set(float64(added))
+	e.metrics.stationsRemoved.Set(float64(removed))
+}
+
+// collectAggregates updates the aggregate metrics, see metrics.aggregates,
+// from the snapshot.
+func (e *Exporter) collectAggregates(snap Snapshot) {
+	records, stations := snap.Records, snap.Stations
+	e.metrics.servedOnly.Reset()
+	for provincia, count := range servedOnlyStations(records, stations) {
+		e.metrics.servedOnly.WithLabelValues(provincia).Set(float64(count))
+	}
+	e.metrics.distinctBrands.Reset()
+	for provincia, count := range distinctBrands(stations) {
+		e.metrics.distinctBrands.WithLabelValues(provincia).Set(float64(count))
+	}
+	// statistics over too few prices are noise, skip them.
+	lowSample := lowSampleGroups(records, stations, e.cfg.MinSamples)
+	e.metrics.lowSampleFuels.Set(float64(len(lowSample)))
+	e.metrics.stdDev.Reset()
+	for k, stddev := range priceStdDev(records, stations) {
+		if lowSample[k] {
+			continue
+		}
+		e.metrics.stdDev.WithLabelValues(k.Carburante, k.Provincia).Set(stddev)
+	}
+	e.metrics.priceMin.Reset()
+	e.metrics.priceMax.Reset()
+	e.metrics.priceAvg.Reset()
+	for k, summary := range provincePrices(records, stations) {
+		if lowSample[k] {
+			continue
+		}
+		e.metrics.priceMin.WithLabelValues(k.Provincia, k.Carburante).Set(summary.Min)
+		e.metrics.priceMax.WithLabelValues(k.Provincia, k.Carburante).Set(summary.Max)
+		e.metrics.priceAvg.WithLabelValues(k.Provincia, k.Carburante).Set(summary.Avg)
+	}
+	e.metrics.density.Reset()
+	for regione, density := range stationDensity(stations) {
+		e.metrics.density.WithLabelValues(regione).Set(density)
+	}
+	e.metrics.selfSavings.Reset()
+	for k, savings := range selfServiceSavings(records, stations) {
+		if lowSample[k] {
+			continue
+		}
+		e.metrics.selfSavings.WithLabelValues(k.Provincia, k.Carburante).Set(savings)
+	}
+	e.metrics.regionNewest.Reset()
+	for regione, ts := range regionNewestReport(records, stations) {
+		e.metrics.regionNewest.WithLabelValues(regione).Set(float64(ts.Unix()))
+	}
+	e.metrics.regionCheapest.Reset()
+	if e.cfg.RegionCheapest {
+		for k, price := range regionCheapest(records, stations) {
+			e.metrics.regionCheapest.WithLabelValues(k.Regione, k.Carburante).Set(price)
+		}
+	}
+	e.metrics.autostradaleSurcharge.Reset()
+	for carburante, surcharge := range autostradaleSurcharge(records, stations) {
+		e.metrics.autostradaleSurcharge.WithLabelValues(carburante).Set(surcharge)
+	}
+	e.metrics.emptyProvinces.Set(float64(emptyProvinces(records, stations)))
+	e.metrics.fuelPrevalence.Reset()
+	for carburante, ratio := range fuelPrevalence(records, stations) {
+		e.metrics.fuelPrevalence.WithLabelValues(carburante).Set(ratio)
+	}
+	e.metrics.fuelCatalog.Reset()
+	for canonical, example := range fuelCatalog(records) {
+		e.metrics.fuelCatalog.WithLabelValues(canonical, example).Set(1)
+	}
+	e.metrics.nationalAverage.Reset()
+	for carburante, avg := range nationalAverages(records) {
+		e.metrics.nationalAverage.WithLabelValues(carburante).Set(avg)
+	}
+	for bucket, count := range stationsByRecency(records, time.Now()) {
+		e.metrics.stationsByRecency.WithLabelValues(bucket).Set(float64(count))
+	}
+	e.metrics.autostradaleRatio.Reset()
+	for regione, ratio := range autostradaleRatio(stations) {
+		e.metrics.autostradaleRatio.WithLabelValues(regione).Set(ratio)
+	}
+	if ratio, ok := reportedRatio(records); ok {
+		e.metrics.reportedRatio.Set(ratio)
+	}
+	for hour, count := range reportsPerHour(records, time.Now()) {
+		e.metrics.reportsPerHour.WithLabelValues(fmt.Sprintf("%02d", hour)).Set(float64(count))
+	}
+	// the histogram describes the current stations only, not all the
+	// refreshes so far.
+	e.metrics.nearestCompetitor.Reset()
+	nearest := e.metrics.nearestCompetitor.WithLabelValues()
+	for _, km := range nearestCompetitorKm(stations) {
+		nearest.Observe(km)
+	}
+}
+
+// pushMetrics pushes the metrics gathered by `g` to the Pushgateway at `url`,
+// under the given job name, with `client`.
+func pushMetrics(url, job string, g prometheus.Gatherer, client *http.Client) error {
+	return push.New(url, job).Client(client).Gatherer(g).Push()
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testPricesCSV and testStationsCSV are small prices and stations files, in
+// the format published by MIMIT.
+const (
+	testPricesCSV = `Estrazione del 2023-10-12
+idImpianto;descCarburante;prezzo;isSelf;dtComu
+1;Benzina;1.899;1;12/10/2023 08:00:00
+1;Gasolio;1.799;0;12/10/2023 08:00:00
+2;Benzina;1.999;0;12/10/2023 09:00:00
+`
+	testStationsCSV = `Estrazione del 2023-10-12
+idImpianto;Gestore;Bandiera;Tipo Impianto;Nome Impianto;Indirizzo;Comune;Provincia;Latitudine;Longitudine
+1;Gestore 1;Eni;Stradale;Eni Roma;Via Roma 1;ROMA;RM;41.9;12.5
+2;Gestore 2;Q8;Autostradale;Q8 Milano;Via Milano 2;MILANO;MI;45.4;9.1
+`
+)
+
+// newTestServer returns a server serving `prices` at /prices and `stations`
+// at /stations.
+func newTestServer(t *testing.T, prices, stations string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, prices)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, stations)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestExporter returns an Exporter downloading the data from `srv`, see
+// newTestServer, without retrying failed downloads.
+func newTestExporter(t *testing.T, srv *httptest.Server, cfg Config) *Exporter {
+	t.Helper()
+	cfg.PricesURL = srv.URL + "/prices"
+	cfg.StationsURL = srv.URL + "/stations"
+	if cfg.RetryAttempts == 0 {
+		cfg.RetryAttempts = 1
+	}
+	e, err := NewExporter(cfg)
+	if err != nil {
+		t.Fatalf("NewExporter failed: %v", err)
+	}
+	return e
+}
+
+// scrape serves a GET request for `target` with `h`, and returns the
+// response.
+func scrape(t *testing.T, h http.Handler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestExporterRefresh(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	want := `
+# HELP osservatorio_carburanti_price Fuel prices from Osservatorio Carburanti from MISE
+# TYPE osservatorio_carburanti_price gauge
+osservatorio_carburanti_price{Bandiera="Eni",Carburante="Benzina",Comune="ROMA",IDImpianto="1",Nome="Eni Roma",Provincia="RM",SelfService="true",Tipo="Stradale"} 1.899
+osservatorio_carburanti_price{Bandiera="Eni",Carburante="Gasolio",Comune="ROMA",IDImpianto="1",Nome="Eni Roma",Provincia="RM",SelfService="false",Tipo="Stradale"} 1.799
+osservatorio_carburanti_price{Bandiera="Q8",Carburante="Benzina",Comune="MILANO",IDImpianto="2",Nome="Q8 Milano",Provincia="MI",SelfService="false",Tipo="Autostradale"} 1.999
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(want), "osservatorio_carburanti_price"); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(e.metrics.lastSuccess); got == 0 {
+		t.Error("last success timestamp not set")
+	}
+}
+
+func TestRefreshKeepsDataOnFailure(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	srv.Close()
+	if err := e.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded with the server down")
+	}
+	if got := len(e.store.Snapshot().Records); got != 3 {
+		t.Errorf("got %d records after a failed refresh, want the previous 3", got)
+	}
+}
+
+func TestRefreshOnScrape(t *testing.T) {
+	var downloads atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{RefreshOnScrape: true, MinRefreshInterval: time.Hour})
+	h := e.Handler()
+
+	for i := 0; i < 2; i++ {
+		if w := scrape(t, h, "/metrics"); w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	if got := downloads.Load(); got != 1 {
+		t.Errorf("got %d downloads after two scrapes of fresh data, want 1", got)
+	}
+
+	// make the data stale.
+	e.refreshMu.Lock()
+	e.lastRefresh = time.Now().Add(-2 * time.Hour)
+	e.refreshMu.Unlock()
+	e.setLastSuccess(time.Now().Add(-2 * time.Hour))
+	w := scrape(t, h, "/metrics")
+	if got := downloads.Load(); got != 2 {
+		t.Errorf("got %d downloads after a scrape of stale data, want 2", got)
+	}
+	if !strings.Contains(w.Body.String(), "osservatorio_carburanti_price{") {
+		t.Error("scrape does not contain the prices")
+	}
+}
+
+func TestRefreshPushesToPushgateway(t *testing.T) {
+	var pushes atomic.Int32
+	var body atomic.Value
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/test" {
+			t.Errorf("unexpected push %s %s", r.Method, r.URL.Path)
+		}
+		b, _ := io.ReadAll(r.Body)
+		body.Store(string(b))
+		pushes.Add(1)
+	}))
+	defer pushgateway.Close()
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{Pushgateway: pushgateway.URL, PushgatewayJob: "test"})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := pushes.Load(); got != 1 {
+		t.Fatalf("got %d pushes, want 1", got)
+	}
+	// the push is in the protobuf format, where the metric names appear
+	// verbatim.
+	if !strings.Contains(body.Load().(string), "osservatorio_carburanti_price") {
+		t.Error("push does not contain the prices")
+	}
+	if got := testutil.ToFloat64(e.metrics.pushErrors); got != 0 {
+		t.Errorf("got %v push errors, want 0", got)
+	}
+
+	pushgateway.Close()
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed because of the push: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.pushErrors); got != 1 {
+		t.Errorf("got %v push errors, want 1", got)
+	}
+}
+
+func TestPushgatewayTimeout(t *testing.T) {
+	release := make(chan struct{})
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer pushgateway.Close()
+	defer close(release)
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{Pushgateway: pushgateway.URL, PushgatewayJob: "test", HTTPTimeout: 100 * time.Millisecond})
+	done := make(chan error)
+	go func() { done <- e.Refresh(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Refresh blocked on a stalled Pushgateway")
+	}
+	if got := testutil.ToFloat64(e.metrics.pushErrors); got != 1 {
+		t.Errorf("got %v push errors, want 1", got)
+	}
+}
+
+func TestTwoExporters(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	for i := 0; i < 2; i++ {
+		e := newTestExporter(t, srv, Config{})
+		if err := e.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh of exporter %d failed: %v", i, err)
+		}
+		got, err := testutil.GatherAndCount(e.registry, "osservatorio_carburanti_price")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 3 {
+			t.Errorf("got %d prices from exporter %d, want 3", got, i)
+		}
+	}
+}
+
+func TestDefaultStationsSchema(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if got, want := e.cfg.StationsSchema, stationsSchemas[defaultStationsSchema]; got != want {
+		t.Errorf("got schema %+v, want the default %+v", got, want)
+	}
+}
+
+// gaugeValue returns the value of the gauge without labels `name` gathered
+// from `g`.
+func gaugeValue(t *testing.T, g prometheus.Gatherer, name string) float64 {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func TestStationsCacheAge(t *testing.T) {
+	const name = "osservatorio_carburanti_stations_cache_age_seconds"
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{StationsInterval: time.Hour})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := gaugeValue(t, e.registry, name); got > 60 {
+		t.Errorf("got a stations age of %vs after downloading them, want about 0", got)
+	}
+
+	// a price-only refresh keeps the stations, and their age.
+	stations := e.store.Snapshot().Stations
+	e.setStations(stations, time.Now().Add(-30*time.Minute))
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := gaugeValue(t, e.registry, name); got < 30*60 {
+		t.Errorf("got a stations age of %vs after a price-only refresh, want at least 30m", got)
+	}
+
+	// stations older than StationsInterval are downloaded again.
+	e.setStations(stations, time.Now().Add(-2*time.Hour))
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := gaugeValue(t, e.registry, name); got > 60 {
+		t.Errorf("got a stations age of %vs after downloading them again, want about 0", got)
+	}
+}
+
+func TestRefreshAllocBytes(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	// parsing allocates, so the gauge cannot be zero.
+	if got := testutil.ToFloat64(e.metrics.refreshAlloc); got <= 0 {
+		t.Errorf("got %v allocated bytes, want more than 0", got)
+	}
+}
+
+func TestLowSampleFuels(t *testing.T) {
+	stations := testStationsCSV + "3;Gestore 3;IP;Stradale;IP Roma;Via Roma 3;ROMA;RM;41.9;12.5\n"
+	// only Benzina in RM has two prices.
+	prices := testPricesCSV + "3;Benzina;1.849;1;12/10/2023 08:00:00\n"
+	srv := newTestServer(t, prices, stations)
+	e := newTestExporter(t, srv, Config{MinSamples: 2})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.lowSampleFuels); got != 2 {
+		t.Errorf("got %v low sample groups, want 2", got)
+	}
+	want := `
+# HELP osservatorio_carburanti_price_min Minimum price, per province and fuel type
+# TYPE osservatorio_carburanti_price_min gauge
+osservatorio_carburanti_price_min{Carburante="Benzina",Provincia="RM"} 1.849
+`
+	if err := testutil.CollectAndCompare(e.metrics.priceMin, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInstanceLabels(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{InstanceLabels: prometheus.Labels{"region": "lazio"}})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	body := scrape(t, e.Handler(), "/metrics").Body.String()
+	if want := `osservatorio_carburanti_price{Bandiera="Eni",Carburante="Benzina",Comune="ROMA",IDImpianto="1",Nome="Eni Roma",Provincia="RM",SelfService="true",Tipo="Stradale",region="lazio"} 1.899`; !strings.Contains(body, want) {
+		t.Errorf("price with the instance label not found in:\n%s", body)
+	}
+	if want := `osservatorio_carburanti_last_success_timestamp_seconds{region="lazio"}`; !strings.Contains(body, want) {
+		t.Errorf("%s not found", want)
+	}
+}
+
+func TestLastSuccessTimestamp(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.lastSuccess); got == 0 {
+		t.Fatal("last success timestamp not set")
+	}
+	// pretend the refresh happened an hour ago, the timestamp has a
+	// resolution of one second.
+	e.setLastSuccess(time.Now().Add(-time.Hour))
+	first := testutil.ToFloat64(e.metrics.lastSuccess)
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	second := testutil.ToFloat64(e.metrics.lastSuccess)
+	if second <= first {
+		t.Errorf("last success timestamp went from %v to %v after a successful refresh, want it to advance", first, second)
+	}
+	srv.Close()
+	if err := e.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded with the server down")
+	}
+	if got := testutil.ToFloat64(e.metrics.lastSuccess); got != second {
+		t.Errorf("last success timestamp changed from %v to %v after a failed refresh", second, got)
+	}
+}
+
+func TestAggregatesHandler(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	body := scrape(t, e.AggregatesHandler(), "/metrics/aggregates").Body.String()
+	if !strings.Contains(body, `osservatorio_carburanti_national_average_price{Carburante="Benzina"} 1.949`) {
+		t.Errorf("national average not found in:\n%s", body)
+	}
+	for _, unwant := range []string{"osservatorio_carburanti_price{", "osservatorio_carburanti_station_info{"} {
+		if strings.Contains(body, unwant) {
+			t.Errorf("per-station metric %s found in the aggregates", unwant)
+		}
+	}
+}
+
+func TestInitialRefresh(t *testing.T) {
+	// the prices are only available from the third request.
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	e := newTestExporter(t, srv, Config{RetryBaseDelay: time.Millisecond})
+	if err := e.InitialRefresh(context.Background(), 2); err == nil {
+		t.Fatal("InitialRefresh succeeded before the prices were available")
+	}
+	if got := len(e.store.Snapshot().Records); got != 0 {
+		t.Errorf("got %d records after a failed initial refresh, want 0", got)
+	}
+
+	requests.Store(0)
+	e = newTestExporter(t, srv, Config{RetryBaseDelay: time.Millisecond})
+	if err := e.InitialRefresh(context.Background(), 3); err != nil {
+		t.Fatalf("InitialRefresh failed: %v", err)
+	}
+	if got := len(e.store.Snapshot().Records); got != 3 {
+		t.Errorf("got %d records, want 3", got)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("got %d prices requests, want 3", got)
+	}
+
+	// a cancelled context stops the retries.
+	requests.Store(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e = newTestExporter(t, srv, Config{RetryBaseDelay: time.Hour})
+	if err := e.InitialRefresh(ctx, 3); err == nil {
+		t.Error("InitialRefresh succeeded with a cancelled context")
+	}
+}
+
+func TestFilterProvinceHeader(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	h := e.Handler()
+	const (
+		roma   = `osservatorio_carburanti_price{Bandiera="Eni",Carburante="Benzina",Comune="ROMA",IDImpianto="1"`
+		milano = `osservatorio_carburanti_price{Bandiera="Q8",Carburante="Benzina",Comune="MILANO",IDImpianto="2"`
+	)
+	for _, tt := range []struct {
+		target, header string
+		wantRoma       bool
+		wantMilano     bool
+	}{
+		{"/metrics", "", true, true},
+		{"/metrics", "MI", false, true},
+		{"/metrics", "RM, MI", true, true},
+		// the query parameter takes precedence
+		{"/metrics?provincia=RM", "MI", true, false},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set(filterProvinceHeader, tt.header)
+		}
+		h.ServeHTTP(w, r)
+		body := w.Body.String()
+		if got := strings.Contains(body, roma); got != tt.wantRoma {
+			t.Errorf("%s with %q: got Roma %t, want %t", tt.target, tt.header, got, tt.wantRoma)
+		}
+		if got := strings.Contains(body, milano); got != tt.wantMilano {
+			t.Errorf("%s with %q: got Milano %t, want %t", tt.target, tt.header, got, tt.wantMilano)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	// every other download of the prices fails, the loop must go on.
+	var downloads atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		if downloads.Add(1)%2 == 0 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	if err := newTestExporter(t, srv, Config{}).Run(context.Background()); err == nil {
+		t.Error("Run succeeded without an interval")
+	}
+
+	e := newTestExporter(t, srv, Config{Interval: 10 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- e.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for downloads.Load() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d downloads, want at least 4", downloads.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+	if e.LastSuccess().IsZero() {
+		t.Error("no refresh succeeded")
+	}
+}
+
+func TestStationsInterval(t *testing.T) {
+	var pricesDownloads, stationsDownloads atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		pricesDownloads.Add(1)
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		stationsDownloads.Add(1)
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	e := newTestExporter(t, srv, Config{StationsInterval: time.Hour})
+	for i := 0; i < 3; i++ {
+		if err := e.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+	}
+	if got := pricesDownloads.Load(); got != 3 {
+		t.Errorf("got %d prices downloads, want 3", got)
+	}
+	if got := stationsDownloads.Load(); got != 1 {
+		t.Errorf("got %d stations downloads on price-only refreshes, want 1", got)
+	}
+
+	// without an interval the stations are downloaded on every refresh.
+	stationsDownloads.Store(0)
+	e = newTestExporter(t, srv, Config{})
+	for i := 0; i < 2; i++ {
+		if err := e.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+	}
+	if got := stationsDownloads.Load(); got != 2 {
+		t.Errorf("got %d stations downloads without an interval, want 2", got)
+	}
+}
+
+func TestStationsSource(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{StationsInterval: time.Hour})
+	for _, tt := range []struct {
+		name string
+		want float64
+	}{
+		{"first refresh", stationsSourceFresh},
+		{"price-only refresh", stationsSourceCache},
+	} {
+		if err := e.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if got := testutil.ToFloat64(e.metrics.stationsSource); got != tt.want {
+			t.Errorf("%s: got stations source %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// stations older than StationsInterval are downloaded again.
+	e.setStations(e.store.Snapshot().Stations, time.Now().Add(-2*time.Hour))
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.stationsSource); got != stationsSourceFresh {
+		t.Errorf("got stations source %v after downloading them again, want %v", got, stationsSourceFresh)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of the `source` label of the per-source metrics.
+const (
+	sourcePrices   = "prices"
+	sourceStations = "stations"
+)
+
+// countingReader counts the bytes read from the wrapped reader. Use it rather
+// than Content-Length to know the size of a download, since MIMIT does not
+// always send it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipBody decompresses a gzip-encoded response body, and closes the response
+// body when closed.
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// newHTTPClient returns the HTTP client used to download the data. Its
+// timeout covers the whole download, including reading the body while it is
+// parsed.
+func newHTTPClient(cfg Config) *http.Client {
+	client := &http.Client{Timeout: cfg.HTTPTimeout}
+	if !cfg.ForceHTTP1 && cfg.DNSServer == "" && len(cfg.PinnedKeys) == 0 {
+		return client
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ForceHTTP1 {
+		// a non-nil, empty, map disables HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if cfg.DNSServer != "" {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Resolver:  newResolver(cfg.DNSServer),
+		}).DialContext
+	}
+	if len(cfg.PinnedKeys) > 0 {
+		// the certificates are still verified as usual, pinning only
+		// restricts which ones are accepted.
+		transport.TLSClientConfig = &tls.Config{VerifyConnection: verifyPinnedKeys(cfg.PinnedKeys)}
+	}
+	client.Transport = transport
+	return client
+}
+
+// errPinMismatch is returned when none of the server's certificates matches
+// the pinned keys.
+var errPinMismatch = errors.New("no certificate matches the pinned keys")
+
+// parsePin parses a pin, i.e. the base64-encoded SHA-256 of a certificate's
+// DER-encoded public key, the same format used by HPKP and curl.
+func parsePin(s string) ([sha256.Size]byte, error) {
+	var pin [sha256.Size]byte
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return pin, fmt.Errorf("failed to decode pin: %w", err)
+	}
+	if len(b) != sha256.Size {
+		return pin, fmt.Errorf("invalid pin length %d, want %d", len(b), sha256.Size)
+	}
+	copy(pin[:], b)
+	return pin, nil
+}
+
+// verifyPinnedKeys returns a tls.Config.VerifyConnection callback accepting
+// the connection only if the public key of one of the server's certificates
+// is pinned, so that intermediate and root keys can be pinned as well.
+func verifyPinnedKeys(pins [][sha256.Size]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if sum == pin {
+					return nil
+				}
+			}
+		}
+		return errPinMismatch
+	}
+}
+
+// newResolver returns a resolver sending all the DNS queries to `server`,
+// as host:port.
+func newResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		// the cgo resolver cannot be pointed at a different server.
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// retryDelay returns how long to wait before retrying after the given number
+// of consecutive failures.
+func retryDelay(base time.Duration, failures int) time.Duration {
+	return base << (failures - 1)
+}
+
+// maxRateLimitedAttempts is how many times a download is attempted when the
+// server keeps answering 429 Too Many Requests.
+const maxRateLimitedAttempts = 3
+
+// retryAfter parses the value of a Retry-After header, either a number of
+// seconds or an HTTP date, and returns how long to wait from `now`. It returns
+// false if the value is missing or invalid.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := t.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// fetch performs a GET request to the given URL of `source` and returns the
+// response body, which the caller must close. The body is requested
+// gzip-compressed: if the server complies, the returned body is decompressed
+// transparently and the returned countingReader counts the compressed bytes,
+// otherwise it is nil. Failed requests, including the ones with a non-2xx
+// status, are retried up to RetryAttempts times, with an exponential backoff
+// starting at RetryBaseDelay. When rate limited, the request is instead
+// retried after the time requested by the server with Retry-After, capped by
+// MaxRetryAfter.
+func (e *Exporter) fetch(ctx context.Context, source, url string) (io.ReadCloser, *countingReader, error) {
+	var resp *http.Response
+	failures, rateLimited := 0, 0
+attempts:
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		// asking for gzip explicitly disables the transparent decompression
+		// of the transport, that would hide the compressed size.
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err = e.client.Do(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) {
+				e.metrics.dnsErrors.Inc()
+			}
+			if errors.Is(err, errPinMismatch) {
+				e.metrics.pinMismatches.Inc()
+			}
+			failures++
+			if failures >= e.cfg.RetryAttempts || ctx.Err() != nil {
+				return nil, nil, err
+			}
+			wait = retryDelay(e.cfg.RetryBaseDelay, failures)
+			log.Printf("Failed to fetch %q, retrying in %s: %v", url, wait, err)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			resp.Body.Close()
+			e.metrics.rateLimited.Inc()
+			rateLimited++
+			var ok bool
+			wait, ok = retryAfter(resp.Header.Get("Retry-After"), time.Now())
+			if !ok || rateLimited >= maxRateLimitedAttempts {
+				return nil, nil, fmt.Errorf("rate limited by %q", url)
+			}
+			if wait > e.cfg.MaxRetryAfter {
+				wait = e.cfg.MaxRetryAfter
+			}
+			log.Printf("Rate limited by %q, retrying in %s", url, wait)
+		case resp.StatusCode < 200 || resp.StatusCode > 299:
+			resp.Body.Close()
+			failures++
+			if failures >= e.cfg.RetryAttempts {
+				// the body is most likely an error page, not a CSV file.
+				return nil, nil, fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, url)
+			}
+			wait = retryDelay(e.cfg.RetryBaseDelay, failures)
+			log.Printf("Unexpected status %d fetching %q, retrying in %s", resp.StatusCode, url, wait)
+		default:
+			break attempts
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	e.metrics.httpProtocol.DeletePartialMatch(prometheus.Labels{"source": source})
+	e.metrics.httpProtocol.WithLabelValues(source, resp.Proto).Set(1)
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return resp.Body, nil, nil
+	}
+	compressed := &countingReader{r: resp.Body}
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("failed to decompress response: %w", err)
+	}
+	return &gzipBody{Reader: gz, body: resp.Body}, compressed, nil
+}
+
+// open returns the contents of `source`, read from `file` if it is not empty,
+// otherwise fetched from `url`, see fetch. Local files are never compressed.
+func (e *Exporter) open(ctx context.Context, source, url, file string) (io.ReadCloser, *countingReader, error) {
+	if file == "" {
+		return e.fetch(ctx, source, url)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s file: %w", source, err)
+	}
+	return f, nil, nil
+}
+
+// setDownloadSize updates the download size metrics of `source`, given the
+// decompressed size, the compressed one, if any, and the number of data rows.
+func (e *Exporter) setDownloadSize(source string, size int64, compressed *countingReader, rows int) {
+	transferred := size
+	if compressed != nil {
+		transferred = compressed.n
+	}
+	e.metrics.downloadBytes.WithLabelValues(source).Set(float64(transferred))
+	e.metrics.lastFileBytes.WithLabelValues(source).Set(float64(size))
+	e.metrics.lastFileRows.WithLabelValues(source).Set(float64(rows))
+	ratio := 1.0
+	if compressed != nil && compressed.n > 0 {
+		ratio = float64(size) / float64(compressed.n)
+	}
+	e.metrics.decompressionRatio.WithLabelValues(source).Set(ratio)
+}
+
+func (e *Exporter) fetchPrices(ctx context.Context) ([]*Record, error) {
+	body, compressed, err := e.open(ctx, sourcePrices, e.cfg.PricesURL, e.cfg.PricesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch prices: %w", err)
+	}
+	defer body.Close()
+	cached := e.newDiskCacheFile(sourcePrices)
+	cr := &countingReader{r: cached.tee(body)}
+	start := time.Now()
+	records, stats, err := parseRecords(cr)
+	e.metrics.parseErrors.Add(float64(stats.Skipped))
+	e.metrics.badTimestamps.Add(float64(stats.BadTimestamps))
+	e.metrics.rows.WithLabelValues(dispositionError).Add(float64(stats.Skipped))
+	if err != nil {
+		cached.abort()
+		if errors.Is(err, errTruncated) {
+			e.metrics.truncatedDownloads.Inc()
+			// the whole file is discarded, but only the incomplete row
+			// errored.
+			e.metrics.rows.WithLabelValues(dispositionError).Inc()
+		}
+		if errors.Is(err, errSchemaMismatch) {
+			e.metrics.schemaMismatches.Inc()
+		}
+		return nil, err
+	}
+	// parsing is streamed, so this includes the download time.
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		e.metrics.parseThroughput.Set(e.parseThroughput.Add(float64(len(records)) / elapsed))
+	}
+	cached.commit()
+	e.metrics.recordsLoaded.Set(float64(len(records)))
+	e.setDownloadSize(sourcePrices, cr.n, compressed, len(records)+stats.Skipped)
+	if e.cfg.PricePrecision > 0 {
+		for decimals, n := range stats.Decimals {
+			if decimals != e.cfg.PricePrecision {
+				e.metrics.unexpectedPrecision.Add(float64(n))
+			}
+		}
+	}
+	records, dropped := validateRecords(records, e.cfg.Validators)
+	for name, n := range dropped {
+		e.metrics.invalidRecords.WithLabelValues(name).Add(float64(n))
+		e.metrics.rows.WithLabelValues(dispositionFiltered).Add(float64(n))
+	}
+	e.metrics.duplicateRows.Set(float64(duplicatePriceRows(records)))
+	deduped := dedupeLatest(records)
+	e.metrics.rows.WithLabelValues(dispositionDedup).Add(float64(len(records) - len(deduped)))
+	records = deduped
+	// the cache keeps the records first seen less than CacheTTL ago: a hit
+	// is a price that did not change since then, and the hit age is how
+	// long ago it was first seen.
+	for _, record := range records {
+		k := fmt.Sprintf("%d-%s-%t-%d", record.IDImpianto, record.Carburante, record.SelfService, record.DataComunicazione.Unix())
+		if _, ok := e.cache.Get(k); !ok {
+			e.cache.Set(k, *record)
+		}
+	}
+	return records, nil
+}
+
+func (e *Exporter) fetchStations(ctx context.Context) (map[int]Station, error) {
+	from := e.cfg.StationsURL
+	if e.cfg.StationsFile != "" {
+		from = e.cfg.StationsFile
+	}
+	log.Printf("Updating stations from %q", from)
+	body, compressed, err := e.open(ctx, sourceStations, e.cfg.StationsURL, e.cfg.StationsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch station data: %w", err)
+	}
+	defer body.Close()
+	cached := e.newDiskCacheFile(sourceStations)
+	cr := &countingReader{r: cached.tee(body)}
+	stations, stats, err := parseStations(cr, e.cfg.StationsSchema)
+	if err != nil {
+		cached.abort()
+		return nil, err
+	}
+	cached.commit()
+	e.metrics.stationsLoaded.Set(float64(len(stations)))
+	e.metrics.conflictingStations.Add(float64(stats.ConflictingDuplicates))
+	e.setDownloadSize(sourceStations, cr.n, compressed, stats.Rows)
+	return stations, nil
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDuplicatePriceRows(t *testing.T) {
+	prices := testPricesCSV + "1;Benzina;1.899;1;12/10/2023 08:00:00\n"
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.duplicateRows); got != 1 {
+		t.Errorf("got %v duplicate rows, want 1", got)
+	}
+}
+
+func TestDownloadSizeWithoutContentLength(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		// flushing before the end of the body makes the server use the
+		// chunked encoding, without a Content-Length.
+		for _, line := range strings.SplitAfter(testPricesCSV, "\n") {
+			io.WriteString(w, line)
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, want := testutil.ToFloat64(e.metrics.downloadBytes.WithLabelValues(sourcePrices)), float64(len(testPricesCSV)); got != want {
+		t.Errorf("got a download size of %v, want %v", got, want)
+	}
+}
+func TestTruncatedPrices(t *testing.T) {
+	var prices atomic.Value
+	prices.Store(testPricesCSV)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, prices.Load().(string))
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+
+	// cut the last row in the middle of the date.
+	prices.Store(testPricesCSV[:len(testPricesCSV)-10])
+	if err := e.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh of a truncated file succeeded")
+	}
+	if got := testutil.ToFloat64(e.metrics.truncatedDownloads); got != 1 {
+		t.Errorf("got %v truncated downloads, want 1", got)
+	}
+	if got := len(e.store.Snapshot().Records); got != 3 {
+		t.Errorf("got %d records after a truncated download, want the previous 3", got)
+	}
+}
+
+func TestDecompressionRatio(t *testing.T) {
+	prices := testPricesCSV + strings.Repeat("1;Benzina;1.899;1;12/10/2023 08:00:00\n", 100)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("got Accept-Encoding %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, prices)
+		gz.Close()
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.decompressionRatio.WithLabelValues(sourcePrices)); got <= 1 {
+		t.Errorf("got a decompression ratio of %v, want more than 1", got)
+	}
+	if got := testutil.ToFloat64(e.metrics.decompressionRatio.WithLabelValues(sourceStations)); got != 1 {
+		t.Errorf("got a decompression ratio of %v for an uncompressed file, want 1", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var requests []time.Time
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		first := len(requests) == 1
+		mu.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	if wait := requests[1].Sub(requests[0]); wait < time.Second {
+		t.Errorf("retried after %s, want at least the 1s of Retry-After", wait)
+	}
+	if got := testutil.ToFloat64(e.metrics.rateLimited); got != 1 {
+		t.Errorf("got %v rate limited requests, want 1", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 10, 12, 8, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"soon", 0, false},
+	} {
+		got, ok := retryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q): got %s, %t, want %s, %t", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRowDispositions(t *testing.T) {
+	prices := testPricesCSV +
+		// malformed
+		"1;Benzina;abc;1;12/10/2023 08:00:00\n" +
+		// duplicate
+		"1;Benzina;1.899;1;12/10/2023 08:00:00\n" +
+		// orphan
+		"3;Benzina;1.899;1;12/10/2023 08:00:00\n"
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{DropOrphans: true})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	want := map[string]float64{
+		dispositionEmitted:  3,
+		dispositionFiltered: 1,
+		dispositionError:    1,
+		dispositionDedup:    1,
+	}
+	total := 0.0
+	for disposition, n := range want {
+		got := testutil.ToFloat64(e.metrics.rows.WithLabelValues(disposition))
+		if got != n {
+			t.Errorf("got %v %s rows, want %v", got, disposition, n)
+		}
+		total += got
+	}
+	if rows := strings.Count(prices, "\n") - 2; total != float64(rows) {
+		t.Errorf("got %v rows in total, want the %d rows read", total, rows)
+	}
+}
+
+func TestForceHTTP1(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	for _, tt := range []struct {
+		forceHTTP1 bool
+		want       string
+	}{
+		{false, "HTTP/2.0"},
+		{true, "HTTP/1.1"},
+	} {
+		e := newTestExporter(t, srv, Config{ForceHTTP1: tt.forceHTTP1})
+		// trust the test server, keeping the rest of the transport.
+		transport, ok := e.client.Transport.(*http.Transport)
+		if !ok {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+			e.client.Transport = transport
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		if err := e.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if got := testutil.ToFloat64(e.metrics.httpProtocol.WithLabelValues(sourcePrices, tt.want)); got != 1 {
+			t.Errorf("protocol %s not used with ForceHTTP1=%t", tt.want, tt.forceHTTP1)
+		}
+	}
+}
+
+func TestLastFileSize(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	for _, tt := range []struct {
+		source string
+		bytes  int
+		rows   int
+	}{
+		{sourcePrices, len(testPricesCSV), 3},
+		{sourceStations, len(testStationsCSV), 2},
+	} {
+		if got := testutil.ToFloat64(e.metrics.lastFileBytes.WithLabelValues(tt.source)); got != float64(tt.bytes) {
+			t.Errorf("%s: got %v bytes, want %d", tt.source, got, tt.bytes)
+		}
+		if got := testutil.ToFloat64(e.metrics.lastFileRows.WithLabelValues(tt.source)); got != float64(tt.rows) {
+			t.Errorf("%s: got %v rows, want %d", tt.source, got, tt.rows)
+		}
+	}
+}
+
+func TestLastFileBytesCompressed(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	io.WriteString(gz, testPricesCSV)
+	gz.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	// the parsed file is the decompressed one, the download the compressed
+	// one.
+	if got := testutil.ToFloat64(e.metrics.lastFileBytes.WithLabelValues(sourcePrices)); got != float64(len(testPricesCSV)) {
+		t.Errorf("got %v parsed bytes, want %d", got, len(testPricesCSV))
+	}
+	if got := testutil.ToFloat64(e.metrics.downloadBytes.WithLabelValues(sourcePrices)); got != float64(compressed.Len()) {
+		t.Errorf("got %v downloaded bytes, want %d", got, compressed.Len())
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	e := newTestExporter(t, srv, Config{HTTPTimeout: 100 * time.Millisecond})
+	done := make(chan error)
+	go func() {
+		_, _, err := e.fetch(context.Background(), sourcePrices, e.cfg.PricesURL)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("got error %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch blocked on a stalled server")
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, testPricesCSV)
+	}))
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{RetryAttempts: 3, RetryBaseDelay: time.Millisecond})
+	body, _, err := e.fetch(context.Background(), sourcePrices, srv.URL)
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	defer body.Close()
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("got %d attempts, want 3", got)
+	}
+	if b, _ := io.ReadAll(body); string(b) != testPricesCSV {
+		t.Errorf("got body %q, want the one of the third attempt", b)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, tt := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+	} {
+		if got := retryDelay(time.Second, tt.failures); got != tt.want {
+			t.Errorf("retryDelay after %d failures: got %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestFetchUnexpectedStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>unavailable</html>", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	_, _, err := e.fetch(context.Background(), sourcePrices, srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v, want one mentioning the status 503", err)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded without the stations")
+	}
+	if got := testutil.ToFloat64(e.metrics.fetchErrors.WithLabelValues(sourceStations)); got != 1 {
+		t.Errorf("got %v stations fetch errors, want 1", got)
+	}
+	if got := testutil.ToFloat64(e.metrics.fetchErrors.WithLabelValues(sourcePrices)); got != 0 {
+		t.Errorf("got %v prices fetch errors, want 0", got)
+	}
+}
+
+func TestLocalFiles(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	pricesFile, stationsFile := filepath.Join(dir, "prices.csv"), filepath.Join(dir, "stations.csv")
+	if err := os.WriteFile(pricesFile, []byte(testPricesCSV), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stationsFile, []byte(testStationsCSV), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestExporter(t, srv, Config{PricesFile: pricesFile, StationsFile: stationsFile})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	snap := e.store.Snapshot()
+	if len(snap.Records) != 3 || len(snap.Stations) != 2 {
+		t.Errorf("got %d records and %d stations, want 3 and 2", len(snap.Records), len(snap.Stations))
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("got %d requests, want none", got)
+	}
+}
+
+// newStubDNSServer starts a DNS server on UDP resolving `host` to 127.0.0.1,
+// answering NXDOMAIN for any other name, and returns its address and the
+// number of queries it received.
+func newStubDNSServer(t *testing.T, host string) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			query := buf[:n]
+			// the name of the only question starts after the 12 bytes
+			// of the header, followed by its type and class.
+			var labels []string
+			i := 12
+			for i < n && query[i] != 0 {
+				l := int(query[i])
+				if i+1+l > n {
+					break
+				}
+				labels = append(labels, string(query[i+1:i+1+l]))
+				i += 1 + l
+			}
+			end := i + 5
+			if end > n {
+				continue
+			}
+			qtype := uint16(query[i+1])<<8 | uint16(query[i+2])
+			resp := append([]byte{}, query[:end]...)
+			// a response, with recursion desired and available.
+			resp[2], resp[3] = 0x81, 0x80
+			// no answer, authority and additional records by default.
+			for j := 6; j < 12; j++ {
+				resp[j] = 0
+			}
+			switch {
+			case !strings.EqualFold(strings.Join(labels, "."), host):
+				// NXDOMAIN
+				resp[3] |= 3
+			case qtype == 1:
+				resp[7] = 1
+				resp = append(resp,
+					// a pointer to the name in the question
+					0xc0, 0x0c,
+					// type A, class IN, TTL of 60s
+					0, 1, 0, 1, 0, 0, 0, 60,
+					0, 4, 127, 0, 0, 1,
+				)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestDNSServer(t *testing.T) {
+	dnsServer, queries := newStubDNSServer(t, "carburanti.test")
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + net.JoinHostPort("carburanti.test", port)
+	e, err := NewExporter(Config{
+		PricesURL:     base + "/prices",
+		StationsURL:   base + "/stations",
+		RetryAttempts: 1,
+		DNSServer:     dnsServer,
+	})
+	if err != nil {
+		t.Fatalf("NewExporter failed: %v", err)
+	}
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if queries.Load() == 0 {
+		t.Error("the configured DNS server was not queried")
+	}
+	if got := testutil.ToFloat64(e.metrics.dnsErrors); got != 0 {
+		t.Errorf("got %v DNS errors, want 0", got)
+	}
+
+	e.cfg.PricesURL = "http://" + net.JoinHostPort("unknown.test", port) + "/prices"
+	if err := e.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded with an unresolvable host")
+	}
+	if got := testutil.ToFloat64(e.metrics.dnsErrors); got != 1 {
+		t.Errorf("got %v DNS errors, want 1", got)
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	pin, err := parsePin(base64.StdEncoding.EncodeToString(sum[:]))
+	if err != nil || pin != sum {
+		t.Errorf("got %x, %v, want %x", pin, err, sum)
+	}
+	for _, s := range []string{"not base64!", base64.StdEncoding.EncodeToString(sum[:16])} {
+		if _, err := parsePin(s); err == nil {
+			t.Errorf("parsePin(%q) succeeded", s)
+		}
+	}
+}
+
+func TestPinnedKeys(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	for _, tt := range []struct {
+		name string
+		pin  [sha256.Size]byte
+		want bool
+	}{
+		{"matching", sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo), true},
+		{"mismatching", sha256.Sum256([]byte("another key")), false},
+	} {
+		e := newTestExporter(t, srv, Config{PinnedKeys: [][sha256.Size]byte{tt.pin}})
+		// trust the test server, keeping the pin verification.
+		e.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+		err := e.Refresh(context.Background())
+		if got := err == nil; got != tt.want {
+			t.Errorf("%s pin: got error %v, want success %t", tt.name, err, tt.want)
+		}
+		if !tt.want && !errors.Is(err, errPinMismatch) {
+			t.Errorf("%s pin: got error %v, want %v", tt.name, err, errPinMismatch)
+		}
+		want := 0.0
+		if !tt.want {
+			want = 1
+		}
+		if got := testutil.ToFloat64(e.metrics.pinMismatches); got != want {
+			t.Errorf("%s pin: got %v pin mismatches, want %v", tt.name, got, want)
+		}
+		// the pins only apply to the download hosts.
+		if e.pushClient.Transport != nil {
+			t.Errorf("%s pin: the push client does not use the default transport", tt.name)
+		}
+	}
+}
+
+func TestLoadedGauges(t *testing.T) {
+	// a malformed row is not loaded.
+	prices := testPricesCSV + "2;Gasolio;abc;0;12/10/2023 09:00:00\n"
+	records, _, err := parseRecords(strings.NewReader(prices))
+	if err != nil {
+		t.Fatalf("parseRecords failed: %v", err)
+	}
+	stations, _, err := parseStations(strings.NewReader(testStationsCSV), stationsSchemas[defaultStationsSchema])
+	if err != nil {
+		t.Fatalf("parseStations failed: %v", err)
+	}
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.recordsLoaded); got != float64(len(records)) {
+		t.Errorf("got %v records loaded, want %d", got, len(records))
+	}
+	if got := testutil.ToFloat64(e.metrics.stationsLoaded); got != float64(len(stations)) {
+		t.Errorf("got %v stations loaded, want %d", got, len(stations))
+	}
+
+	// the gauges are overwritten by the next refresh.
+	e.cfg.PricesURL = newTestServer(t, "Estrazione del 2023-10-12\nidImpianto;descCarburante;prezzo;isSelf;dtComu\n1;Benzina;1.899;1;12/10/2023 08:00:00\n", testStationsCSV).URL + "/prices"
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.recordsLoaded); got != 1 {
+		t.Errorf("got %v records loaded after the second refresh, want 1", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import "strings"
+
+// Fuel categories, used to export the prices of fuels sold in different units
+// under different metric names, see Config.SplitFuelMetrics.
+const (
+	fuelCategoryLiquid = "liquid"
+	fuelCategoryGas    = "gas"
+)
+
+var fuelCategories = []string{fuelCategoryLiquid, fuelCategoryGas}
+
+// gasFuels are lowercase substrings identifying gaseous fuels in the
+// `Carburante` field, e.g. "Metano", "GPL", "GNL" or "L-GNC".
+var gasFuels = []string{"metano", "gpl", "gnl", "gnc"}
+
+// fuelCategory returns the category of a fuel, as named by MIMIT.
+func fuelCategory(carburante string) string {
+	c := strings.ToLower(carburante)
+	for _, gas := range gasFuels {
+		if strings.Contains(c, gas) {
+			return fuelCategoryGas
+		}
+	}
+	return fuelCategoryLiquid
+}
+
+// fuelCategoryMetric returns the name of the price metric of a category.
+func fuelCategoryMetric(category string) string {
+	return "osservatorio_carburanti_price_" + category
+}
+
+// canonicalFuels maps lowercase substrings of the `Carburante` field to the
+// canonical fuel they are a variant of, e.g. "Blue Diesel" is "gasolio".
+// The first matching substring wins, so the more specific ones come first.
+var canonicalFuels = []struct {
+	substring string
+	canonical string
+}{
+	{"gnl", "gnl"},
+	{"gnc", "metano"},
+	{"metano", "metano"},
+	{"gpl", "gpl"},
+	{"hvo", "hvo"},
+	{"gasolio", "gasolio"},
+	{"diesel", "gasolio"},
+	{"benzina", "benzina"},
+	{"super", "benzina"},
+}
+
+// fuelOther is the canonical name of the fuels not in canonicalFuels.
+const fuelOther = "altro"
+
+// canonicalFuel returns the canonical name of a fuel, as named by MIMIT.
+func canonicalFuel(carburante string) string {
+	c := strings.ToLower(carburante)
+	for _, f := range canonicalFuels {
+		if strings.Contains(c, f.substring) {
+			return f.canonical
+		}
+	}
+	return fuelOther
+}
+
+// fuelCatalog returns, for each canonical fuel with at least one record, an
+// example of its names as reported: the most common one, or the first in
+// alphabetical order among equally common ones.
+func fuelCatalog(records []*Record) map[string]string {
+	counts := make(map[string]int)
+	for _, record := range records {
+		counts[record.Carburante]++
+	}
+	examples := make(map[string]string)
+	for carburante, n := range counts {
+		canonical := canonicalFuel(carburante)
+		example, ok := examples[canonical]
+		if !ok || n > counts[example] || (n == counts[example] && carburante < example) {
+			examples[canonical] = carburante
+		}
+	}
+	return examples
+}
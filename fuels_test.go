@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFuelCatalog(t *testing.T) {
+	var records []*Record
+	for _, carburante := range []string{
+		"Benzina", "Benzina", "Super Plus",
+		"Gasolio", "Blue Diesel", "Blue Diesel",
+		// equally common, the first in alphabetical order wins
+		"GPL", "Gpl",
+		"Idrogeno",
+	} {
+		records = append(records, &Record{Carburante: carburante})
+	}
+	want := map[string]string{
+		"benzina": "Benzina",
+		"gasolio": "Blue Diesel",
+		"gpl":     "GPL",
+		fuelOther: "Idrogeno",
+	}
+	if got := fuelCatalog(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFuelCatalogMetric(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	want := `
+# HELP osservatorio_carburanti_fuel_catalog_info Always 1 for each canonical fuel type with prices, with an example of its names as reported
+# TYPE osservatorio_carburanti_fuel_catalog_info gauge
+osservatorio_carburanti_fuel_catalog_info{canonical="benzina",example="Benzina"} 1
+osservatorio_carburanti_fuel_catalog_info{canonical="gasolio",example="Gasolio"} 1
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(want), "osservatorio_carburanti_fuel_catalog_info"); err != nil {
+		t.Error(err)
+	}
+
+	// fuels no longer reported are removed from the catalog.
+	e.cfg.PricesURL = newTestServer(t, strings.Replace(testPricesCSV, "1;Gasolio;1.799;0;", "1;Benzina;1.799;0;", 1), testStationsCSV).URL + "/prices"
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	want = `
+# HELP osservatorio_carburanti_fuel_catalog_info Always 1 for each canonical fuel type with prices, with an example of its names as reported
+# TYPE osservatorio_carburanti_fuel_catalog_info gauge
+osservatorio_carburanti_fuel_catalog_info{canonical="benzina",example="Benzina"} 1
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(want), "osservatorio_carburanti_fuel_catalog_info"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const earthRadiusKm = 6371.0
+
+// haversineKm returns the great-circle distance in kilometers between two
+// points expressed in degrees.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// parseCoordinates parses a latitude and a longitude in degrees. If either is
+// missing, not numeric or out of range, both are returned as NaN with an
+// error.
+func parseCoordinates(lat, lon string) (float64, float64, error) {
+	nan := math.NaN()
+	if lat == "" || lon == "" {
+		return nan, nan, fmt.Errorf("missing latitude or longitude")
+	}
+	latF, err := strconv.ParseFloat(lat, 64)
+	if err != nil {
+		return nan, nan, fmt.Errorf("latitude is not a float string: %w", err)
+	}
+	lonF, err := strconv.ParseFloat(lon, 64)
+	if err != nil {
+		return nan, nan, fmt.Errorf("longitude is not a float string: %w", err)
+	}
+	if latF < -90 || latF > 90 {
+		return nan, nan, fmt.Errorf("latitude %g is out of range", latF)
+	}
+	if lonF < -180 || lonF > 180 {
+		return nan, nan, fmt.Errorf("longitude %g is out of range", lonF)
+	}
+	return latF, lonF, nil
+}
+
+// stationCoordinates returns the coordinates of a station, and false if they
+// are not valid.
+func stationCoordinates(station Station) (float64, float64, bool) {
+	if math.IsNaN(station.LatF) || math.IsNaN(station.LonF) {
+		return 0, 0, false
+	}
+	return station.LatF, station.LonF, true
+}
+
+// roundCoordinate rounds a coordinate to the given number of decimals,
+// snapping it to a grid. Values that are not numeric are returned unchanged,
+// and so are all values if `decimals` is not positive.
+func roundCoordinate(value string, decimals int) string {
+	if decimals <= 0 {
+		return value
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	scale := math.Pow10(decimals)
+	return strconv.FormatFloat(math.Round(v*scale)/scale, 'f', decimals, 64)
+}
+
+const (
+	// gridCellDeg is the size in degrees of the cells of the spatial grid
+	// used to find the nearest neighbors.
+	gridCellDeg = 0.1
+	// gridCellMinKm is a lower bound of the size in kilometers of a grid
+	// cell side, valid up to 60 degrees of latitude, where a degree of
+	// longitude is half as long as at the equator.
+	gridCellMinKm = gridCellDeg * earthRadiusKm * math.Pi / 180 * 0.5
+	// gridMaxRings bounds the search for isolated stations.
+	gridMaxRings = 50
+)
+
+// nearestCompetitorKm returns, for every station with valid coordinates, the
+// distance in kilometers to the nearest other station. Stations are indexed in
+// a grid, so that only the cells around each station are searched.
+func nearestCompetitorKm(stations map[int]Station) []float64 {
+	type point struct {
+		lat, lon float64
+	}
+	type cell struct {
+		x, y int
+	}
+	cellOf := func(p point) cell {
+		return cell{x: int(math.Floor(p.lat / gridCellDeg)), y: int(math.Floor(p.lon / gridCellDeg))}
+	}
+	grid := make(map[cell][]point)
+	var points []point
+	for _, station := range stations {
+		lat, lon, ok := stationCoordinates(station)
+		if !ok {
+			continue
+		}
+		p := point{lat: lat, lon: lon}
+		points = append(points, p)
+		c := cellOf(p)
+		grid[c] = append(grid[c], p)
+	}
+	var distances []float64
+	for _, p := range points {
+		c := cellOf(p)
+		best := math.Inf(1)
+		skippedSelf := false
+		for r := 0; r <= gridMaxRings; r++ {
+			// the stations in ring r are at least (r-1) cells away, stop
+			// when they cannot be closer than the best match.
+			if r > 0 && float64(r-1)*gridCellMinKm > best {
+				break
+			}
+			for dx := -r; dx <= r; dx++ {
+				for dy := -r; dy <= r; dy++ {
+					if max(abs(dx), abs(dy)) != r {
+						continue
+					}
+					for _, q := range grid[cell{x: c.x + dx, y: c.y + dy}] {
+						// skip the station itself, but not other stations with
+						// the same coordinates.
+						if q == p && !skippedSelf {
+							skippedSelf = true
+							continue
+						}
+						if d := haversineKm(p.lat, p.lon, q.lat, q.lon); d < best {
+							best = d
+						}
+					}
+				}
+			}
+		}
+		if !math.IsInf(best, 1) {
+			distances = append(distances, best)
+		}
+	}
+	return distances
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNearestCompetitorKm(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, LatF: 45, LonF: 9},
+		2: {ID: 2, LatF: 45, LonF: 9.01},
+		// a few cells away from the others
+		3: {ID: 3, LatF: 45.5, LonF: 9},
+		// invalid coordinates
+		4: {ID: 4, LatF: math.NaN(), LonF: math.NaN()},
+	}
+	ab := haversineKm(45, 9, 45, 9.01)
+	ac := haversineKm(45, 9, 45.5, 9)
+	want := []float64{ab, ab, ac}
+	got := nearestCompetitorKm(stations)
+	sort.Float64s(got)
+	if len(got) != len(want) {
+		t.Fatalf("got distances %v, want %v", got, want)
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("got distances %v, want %v", got, want)
+			break
+		}
+	}
+	// sanity check the distances themselves: 0.01 degrees of longitude at
+	// 45 degrees of latitude are about 0.79km, 0.5 degrees of latitude about
+	// 55.6km.
+	if math.Abs(ab-0.786) > 0.01 || math.Abs(ac-55.6) > 0.1 {
+		t.Errorf("got haversine distances %v and %v, want about 0.786 and 55.6", ab, ac)
+	}
+}
+
+func TestRoundCoordinate(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		decimals int
+		want     string
+	}{
+		{"41.9028", 0, "41.9028"},
+		{"41.9028", 2, "41.90"},
+		{"12.4964", 2, "12.50"},
+		{"12.4964", 1, "12.5"},
+		{"", 2, ""},
+		{"n/a", 2, "n/a"},
+	} {
+		if got := roundCoordinate(tt.value, tt.decimals); got != tt.want {
+			t.Errorf("roundCoordinate(%q, %d): got %q, want %q", tt.value, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestStationInfoGeoPrecision(t *testing.T) {
+	stations := strings.Replace(testStationsCSV, "RM;41.9;12.5", "RM;41.9028;12.4964", 1)
+	srv := newTestServer(t, testPricesCSV, stations)
+	e := newTestExporter(t, srv, Config{GeoPrecision: 2})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	body := scrape(t, e.Handler(), "/metrics").Body.String()
+	if want := `Lat="41.90",Long="12.50"`; !strings.Contains(body, want) {
+		t.Errorf("rounded coordinates %s not found in the station info", want)
+	}
+}
+
+func TestParseCoordinates(t *testing.T) {
+	lat, lon, err := parseCoordinates("41.9", "12.5")
+	if err != nil || lat != 41.9 || lon != 12.5 {
+		t.Errorf("got %v, %v, %v, want 41.9, 12.5, nil", lat, lon, err)
+	}
+	for _, tt := range []struct {
+		lat, lon string
+	}{
+		{"91", "12.5"},
+		{"41.9", "-181"},
+		{"", "12.5"},
+		{"41.9", "abc"},
+	} {
+		lat, lon, err := parseCoordinates(tt.lat, tt.lon)
+		if err == nil || !math.IsNaN(lat) || !math.IsNaN(lon) {
+			t.Errorf("parseCoordinates(%q, %q): got %v, %v, %v, want NaN and an error", tt.lat, tt.lon, lat, lon, err)
+		}
+	}
+}
+
+func TestParseStationsInvalidCoordinates(t *testing.T) {
+	csv := testStationsCSV + "3;Gestore 3;IP;Stradale;IP Roma;Via Roma 3;ROMA;RM;;\n"
+	stations, _, err := parseStations(strings.NewReader(csv), stationsSchemas[defaultStationsSchema])
+	if err != nil {
+		t.Fatalf("parseStations failed: %v", err)
+	}
+	if s := stations[3]; !math.IsNaN(s.LatF) || !math.IsNaN(s.LonF) {
+		t.Errorf("got coordinates %v, %v for empty fields, want NaN", s.LatF, s.LonF)
+	}
+	if s := stations[1]; s.LatF != 41.9 || s.LonF != 12.5 {
+		t.Errorf("got coordinates %v, %v, want 41.9, 12.5", s.LatF, s.LonF)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HandleHealth registers the health check handlers on `mux`:
+//   - /ready returns 200 once both the prices and the stations are
+//     available, 503 before.
+//   - /healthz returns 200 if the last successful refresh is less than
+//     HealthMaxAge old, 503 if it is older or if no refresh succeeded yet.
+func (e *Exporter) HandleHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/ready", e.handleReady)
+	mux.HandleFunc("/healthz", e.handleHealthz)
+}
+
+// ready returns an error explaining why the exporter is not ready to serve
+// meaningful metrics yet, or nil if it is. Prices are only stored together
+// with the stations, so a failed stations fetch keeps both unavailable.
+func (e *Exporter) ready() error {
+	snap := e.store.Snapshot()
+	if snap.Updated.IsZero() {
+		return fmt.Errorf("prices not available yet")
+	}
+	if snap.Stations == nil || snap.StationsUpdated.IsZero() {
+		return fmt.Errorf("stations not available yet")
+	}
+	return nil
+}
+
+func (e *Exporter) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := e.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// healthzResponse is the JSON body of /healthz. LastSuccess is null if no
+// refresh succeeded yet.
+type healthzResponse struct {
+	Status      string     `json:"status"`
+	LastSuccess *time.Time `json:"last_success"`
+}
+
+func (e *Exporter) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	resp := healthzResponse{Status: "ok"}
+	status := http.StatusOK
+	lastSuccess := e.LastSuccess()
+	if !lastSuccess.IsZero() {
+		resp.LastSuccess = &lastSuccess
+	}
+	if lastSuccess.IsZero() || time.Since(lastSuccess) > e.cfg.HealthMaxAge {
+		resp.Status = "stale"
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to write healthz response: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyWaitsForStations(t *testing.T) {
+	var stationsUp atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testPricesCSV)
+	})
+	mux.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) {
+		if !stationsUp.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, testStationsCSV)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	e := newTestExporter(t, srv, Config{})
+	health := http.NewServeMux()
+	e.HandleHealth(health)
+
+	if err := e.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded without the stations")
+	}
+	if w := scrape(t, health, "/ready"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without the stations, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	stationsUp.Store(true)
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if w := scrape(t, health, "/ready"); w.Code != http.StatusOK {
+		t.Errorf("got status %d with both sources, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{HealthMaxAge: time.Hour})
+	health := http.NewServeMux()
+	e.HandleHealth(health)
+
+	for _, tt := range []struct {
+		name        string
+		lastSuccess time.Time
+		wantCode    int
+		wantStatus  string
+	}{
+		{"never loaded", time.Time{}, http.StatusServiceUnavailable, "stale"},
+		{"fresh", time.Now().Add(-time.Minute), http.StatusOK, "ok"},
+		{"stale", time.Now().Add(-2 * time.Hour), http.StatusServiceUnavailable, "stale"},
+	} {
+		e.setLastSuccess(tt.lastSuccess)
+		w := scrape(t, health, "/healthz")
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		var resp healthzResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: invalid JSON body: %v", tt.name, err)
+		}
+		if resp.Status != tt.wantStatus {
+			t.Errorf("%s: got status %q, want %q", tt.name, resp.Status, tt.wantStatus)
+		}
+		if tt.lastSuccess.IsZero() != (resp.LastSuccess == nil) {
+			t.Errorf("%s: got last_success %v, want %v", tt.name, resp.LastSuccess, tt.lastSuccess)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const influxMeasurement = "osservatorio_carburanti_price"
+
+// influxEscaper escapes tag keys and values in InfluxDB line protocol.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxLines encodes the price records as InfluxDB line protocol, one line
+// per record. The price labels become tags, the price is the `prezzo` field
+// rounded to `precision` decimals, see roundPrice, and the report time, if
+// valid, is the timestamp. Empty tags are omitted, as the line protocol does
+// not allow them.
+func influxLines(records []*Record, stations map[int]Station, precision int) []byte {
+	var buf bytes.Buffer
+	for _, record := range records {
+		buf.WriteString(influxMeasurement)
+		for i, value := range priceLabelValues(record, stations) {
+			if value == "" {
+				continue
+			}
+			buf.WriteByte(',')
+			buf.WriteString(influxEscaper.Replace(priceLabels[i]))
+			buf.WriteByte('=')
+			buf.WriteString(influxEscaper.Replace(value))
+		}
+		buf.WriteString(" prezzo=")
+		buf.WriteString(strconv.FormatFloat(roundPrice(record.Prezzo, precision), 'f', -1, 64))
+		// records with an invalid report time have no timestamp, InfluxDB
+		// uses the time it receives them instead.
+		if !record.DataComunicazione.IsZero() {
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatInt(record.DataComunicazione.UnixNano(), 10))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// pushInflux writes the current snapshot as line protocol to the configured
+// InfluxDB (or compatible, e.g. VictoriaMetrics) write URL.
+func (e *Exporter) pushInflux(ctx context.Context) error {
+	snap := e.store.Snapshot()
+	body := influxLines(priceRecords(snap, e.cfg.DropOrphans), snap.Stations, e.cfg.PricePrecision)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.InfluxURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := e.pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
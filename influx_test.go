@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPushInflux(t *testing.T) {
+	var body atomic.Value
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		b, _ := io.ReadAll(r.Body)
+		body.Store(string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{InfluxURL: influx.URL + "/write"})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	got, _ := body.Load().(string)
+	for _, want := range []string{
+		`osservatorio_carburanti_price,IDImpianto=1,Carburante=Benzina,SelfService=true,Nome=Eni\ Roma,Tipo=Stradale,Comune=ROMA,Provincia=RM,Bandiera=Eni prezzo=1.899 1697090400000000000`,
+		`osservatorio_carburanti_price,IDImpianto=2,Carburante=Benzina,SelfService=false,Nome=Q8\ Milano,Tipo=Autostradale,Comune=MILANO,Provincia=MI,Bandiera=Q8 prezzo=1.999 1697094000000000000`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("line %q not found in:\n%s", want, got)
+		}
+	}
+}
+
+func TestPushInfluxWithoutReportTime(t *testing.T) {
+	var body atomic.Value
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body.Store(string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+	prices := strings.Replace(testPricesCSV, "2;Benzina;1.999;0;12/10/2023 09:00:00", "2;Benzina;1.999;0;not a time", 1)
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{InfluxURL: influx.URL + "/write"})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	// the server assigns its own time to the points without a timestamp.
+	want := `osservatorio_carburanti_price,IDImpianto=2,Carburante=Benzina,SelfService=false,Nome=Q8\ Milano,Tipo=Autostradale,Comune=MILANO,Provincia=MI,Bandiera=Q8 prezzo=1.999`
+	if got, _ := body.Load().(string); !strings.Contains(got, want+"\n") {
+		t.Errorf("line %q not found in:\n%s", want, got)
+	}
+}
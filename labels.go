@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// asciiFold transliterates `s` to ASCII by removing the accents, e.g. "città"
+// becomes "citta". Characters without an ASCII equivalent are dropped.
+func asciiFold(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return s
+	}
+	var b strings.Builder
+	// the compatibility decomposition splits accented letters into the base
+	// letter followed by combining marks, that are not ASCII.
+	for _, r := range norm.NFKD.String(s) {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// asciiLabelValues folds every label value to ASCII, in place, and returns
+// the values.
+func asciiLabelValues(values []string) []string {
+	for i, v := range values {
+		values[i] = asciiFold(v)
+	}
+	return values
+}
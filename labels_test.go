@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestASCIIFold(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"ROMA", "ROMA"},
+		{"città", "citta"},
+		{"FORLÌ", "FORLI"},
+		{"Caffè Né", "Caffe Ne"},
+	} {
+		if got := asciiFold(tt.in); got != tt.want {
+			t.Errorf("asciiFold(%q): got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestASCIILabels(t *testing.T) {
+	stations := strings.Replace(testStationsCSV, "Eni Roma;Via Roma 1;ROMA", "Eni Forlì;Via Roma 1;FORLÌ", 1)
+	srv := newTestServer(t, testPricesCSV, stations)
+	for _, tt := range []struct {
+		asciiLabels bool
+		want        string
+	}{
+		{false, `Comune="FORLÌ",IDImpianto="1",Nome="Eni Forlì"`},
+		{true, `Comune="FORLI",IDImpianto="1",Nome="Eni Forli"`},
+	} {
+		e := newTestExporter(t, srv, Config{ASCIILabels: tt.asciiLabels})
+		if err := e.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if body := scrape(t, e.Handler(), "/metrics").Body.String(); !strings.Contains(body, tt.want) {
+			t.Errorf("labels %s not found with ASCIILabels=%t", tt.want, tt.asciiLabels)
+		}
+	}
+}
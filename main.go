@@ -1,27 +1,116 @@
 package main
 
 import (
-	"bufio"
-	"encoding/csv"
+	"context"
+	"crypto/sha256"
 	"flag"
-	"fmt"
-	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	flagPath          = flag.String("p", "/metrics", "HTTP path where to expose metrics to")
-	flagListen        = flag.String("l", ":9112", "Address to listen to")
-	flagSleepInterval = flag.Duration("i", 6*time.Hour, "Interval between data updates, expressed as a Go duration string")
+	flagPath           = flag.String("p", "/metrics", "HTTP path where to expose metrics to")
+	flagListen         = flag.String("l", ":9112", "Address to listen to")
+	flagSleepInterval  = flag.Duration("i", 6*time.Hour, "Interval between data updates, expressed as a Go duration string")
+	flagStationsSchema = flag.String("stations-schema", defaultStationsSchema, "Version of the column layout of the stations CSV file: v1, the current one, or v0, the older one without the station names")
+	flagMinPrice       = flag.Float64("min-price", 0, "If greater than zero, drop price records lower than this")
+	flagMaxPrice       = flag.Float64("max-price", 0, "If greater than zero, drop price records higher than this")
+	flagCacheTTL       = flag.Duration("cache-ttl", time.Hour, "How long cached price records are considered valid")
+	flagUseReportTime  = flag.Bool("use-report-timestamp", false, "Export prices with their report time as sample timestamp")
+	flagMaxSampleAge   = flag.Duration("max-sample-age", time.Hour, "With -use-report-timestamp, reports older than this are exported with the current time")
+	flagDropOrphans    = flag.Bool("drop-orphans", false, "Do not export prices of stations without metadata")
+	flagDecimalSep     = flag.String("decimal-separator", ".", "Decimal separator used for prices in the API and CSV export, e.g. \",\" for Italian locales")
+	flagDumpRecords    = flag.Int("dump-records", 0, "If greater than zero, fetch the data once, print this many parsed records to stdout and exit")
+	flagLogLevel       = flag.String("log-level", "info", "Log level for the HTTP access log, one of debug, info, warn, error")
+	flagShutdownGrace  = flag.Duration("shutdown-grace", 30*time.Second, "On SIGINT or SIGTERM, how long to wait for in-flight HTTP requests to complete")
+
+	flagRefreshOnScrape    = flag.Bool("refresh-on-scrape", false, "Refresh data when scraped instead of periodically in the background")
+	flagMinRefreshInterval = flag.Duration("min-refresh-interval", time.Hour, "Minimum interval between two refreshes when using -refresh-on-scrape")
+	flagAggregatesOnScrape = flag.Bool("recompute-aggregates-on-scrape", false, "Compute the aggregate metrics from the current data when scraped, instead of after each refresh")
+	flagPushgateway        = flag.String("pushgateway", "", "If set, URL of a Pushgateway where to push metrics to after each refresh")
+	flagPushgatewayJob     = flag.String("pushgateway-job", "carburanti_exporter", "Job name to use when pushing to the Pushgateway")
+	flagTenants            = flag.String("tenants", "", "If set, path to a JSON file listing additional metric paths, each exposing the prices matching its own filter")
+	flagInfluxURL          = flag.String("influx-url", "", "If set, InfluxDB line protocol write URL where to push prices to after each refresh")
+	flagMaxRetryAfter      = flag.Duration("max-retry-after", 5*time.Minute, "Maximum time to wait before retrying a download rejected with 429 Too Many Requests")
+	flagActiveOnly         = flag.Bool("active-only", false, "Only keep the metadata of stations with prices reported within -stale-after")
+	flagStaleAfter         = flag.Duration("stale-after", 7*24*time.Hour, "With -active-only, stations without prices reported within this are excluded")
+	flagASCIILabels        = flag.Bool("ascii-labels", false, "Transliterate price label values to ASCII, e.g. \"città\" to \"citta\"")
+	flagSplitFuelMetrics   = flag.Bool("split-fuel-metrics", false, "Export the prices of liquid and gaseous fuels as separate osservatorio_carburanti_price_liquid and osservatorio_carburanti_price_gas metrics")
+	flagCacheDir           = flag.String("cache-dir", "", "If set, directory where to save the downloaded files, to serve them right away on the next start while refreshing")
+	flagGeoPrecision       = flag.Int("geo-precision", 0, "If greater than zero, number of decimals the station coordinates are rounded to in the station info metric, e.g. 2 for a 0.01 degrees grid")
+	flagMinSamples         = flag.Int("min-samples", 0, "Minimum number of prices of a fuel type in a province to export statistics, such as the standard deviation, about them")
+	flagAPICacheTTL        = flag.Duration("api-cache-ttl", 10*time.Second, "How long API responses are cached, 0 to disable caching")
+	flagRegionCheapest     = flag.Bool("region-cheapest", false, "Export the lowest price of each fuel type per region")
+	flagForceHTTP1         = flag.Bool("force-http1", false, "Disable HTTP/2 when downloading the data, e.g. to work around GOAWAY errors")
+	flagHTTPTimeout        = flag.Duration("http-timeout", 30*time.Second, "Maximum duration of a download, including reading the whole file")
+	flagRetryAttempts      = flag.Int("retry-attempts", 3, "How many times a download is attempted before giving up")
+	flagRetryBaseDelay     = flag.Duration("retry-base-delay", 10*time.Second, "Time to wait before retrying a failed download, doubled after each attempt")
+	flagThroughputDecay    = flag.Float64("throughput-decay", 0.3, "Weight, between 0 and 1, of the latest refresh in the moving average of the parse throughput")
+	flagPricePrecision     = flag.Int("price-precision", 0, "If greater than zero, number of decimals the exported prices are rounded to, e.g. 3")
+	flagAuditStations      = flag.Bool("audit-station-changes", false, "Log the changes of the stations' metadata between refreshes")
+	flagProvince           = flag.String("provincia", "", "Comma-separated list of provinces, e.g. RM,MI,NA, to only export the stations in them")
+	flagCarburante         = flag.String("carburante", "", "Comma-separated list of fuel types, e.g. Gasolio,GPL, to only export their prices. Matching is case-insensitive")
+	flagPricesURL          = flag.String("prices-url", pricesCSVURL, "URL of the prices CSV file")
+	flagStationsURL        = flag.String("stations-url", stationsCSVURL, "URL of the stations CSV file")
+	flagPricesFile         = flag.String("prices-file", "", "Local prices CSV file to read instead of downloading it")
+	flagStationsFile       = flag.String("stations-file", "", "Local stations CSV file to read instead of downloading it")
+	flagHealthMaxAge       = flag.Duration("healthz-max-age", 3*time.Hour, "Maximum age of the last successful refresh for /healthz to report healthy")
+	flagDeltaMaxTokens     = flag.Int("delta-max-tokens", 100, "Maximum number of client tokens the delta metrics endpoint keeps track of, the least recently seen one is forgotten first")
+	flagDeltaTokenTTL      = flag.Duration("delta-token-ttl", time.Hour, "How long the delta metrics endpoint remembers what it served to a client token after its last scrape")
+	flagDNSServer          = flag.String("dns-server", "", "DNS server, as host:port, to resolve the download hosts with, instead of the system's resolvers")
+	flagInitialAttempts    = flag.Int("initial-refresh-attempts", 3, "How many times the first refresh is attempted before exiting, unless warmed up from -cache-dir")
+	flagStationsInterval   = flag.Duration("stations-interval", 24*time.Hour, "Minimum interval between downloads of the stations, refreshes in between reuse the last downloaded ones")
+	flagInstanceLabel      = flag.String("instance-label", "", "Constant label to add to all the metrics, as name=value, e.g. region=lazio")
 )
 
+// stringsFlag is a flag that can be repeated, collecting all its values.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// splitList splits a comma-separated list, ignoring empty items. It returns
+// nil for an empty list.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var (
+	flagExcludeProvinces stringsFlag
+	flagExcludeComuni    stringsFlag
+	flagReferencePrices  stringsFlag
+	flagPinSHA256        stringsFlag
+)
+
+func init() {
+	flag.Var(&flagExcludeProvinces, "exclude-province", "Province whose stations are not exported, can be repeated")
+	flag.Var(&flagExcludeComuni, "exclude-comune", "Comune whose stations are not exported, can be repeated")
+	flag.Var(&flagReferencePrices, "reference-price", "Reference price of a fuel type, as fuel=price, e.g. Gasolio=1.800, to compare the prices with. Can be repeated")
+	flag.Var(&flagPinSHA256, "pin-sha256", "Base64-encoded SHA-256 of a public key accepted for the download hosts' certificates. Can be repeated, connections matching none of them are rejected")
+}
+
 // See https://www.mimit.gov.it/index.php/it/open-data/elenco-dataset/carburanti-prezzi-praticati-e-anagrafica-degli-impianti
 const (
 	pricesCSVURL   = "https://www.mimit.gov.it/images/exportCSV/prezzo_alle_8.csv"
@@ -31,219 +120,215 @@ const (
 func main() {
 	flag.Parse()
 
-	carburantiGauge := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "osservatorio_carburanti_price",
-			Help: "Fuel prices from Osservatorio Carburanti from MISE",
-		},
-		[]string{"IDImpianto", "Carburante", "SelfService", "Nome", "Tipo", "Comune", "Provincia", "Bandiera"},
-	)
-	if err := prometheus.Register(carburantiGauge); err != nil {
-		log.Fatalf("Failed to register 'osservatorio_carburanti_price' gauge: %v", err)
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(*flagLogLevel)); err != nil {
+		log.Fatalf("Invalid log level %q: %v", *flagLogLevel, err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	stationsSchema, err := stationsSchemaByName(*flagStationsSchema)
+	if err != nil {
+		log.Fatalf("Invalid -stations-schema: %v", err)
 	}
 
-	cache := NewCache(time.Hour)
+	if *flagRetryAttempts < 1 {
+		log.Fatalf("Invalid -retry-attempts %d: must be at least 1", *flagRetryAttempts)
+	}
+	if *flagSleepInterval <= 0 && !*flagRefreshOnScrape {
+		log.Fatalf("Invalid -i %s: must be positive", *flagSleepInterval)
+	}
+	if *flagInitialAttempts < 1 {
+		log.Fatalf("Invalid -initial-refresh-attempts %d: must be at least 1", *flagInitialAttempts)
+	}
+	if *flagDeltaMaxTokens < 1 {
+		log.Fatalf("Invalid -delta-max-tokens %d: must be at least 1", *flagDeltaMaxTokens)
+	}
+	if *flagThroughputDecay <= 0 || *flagThroughputDecay > 1 {
+		log.Fatalf("Invalid -throughput-decay %f: must be greater than 0 and at most 1", *flagThroughputDecay)
+	}
 
-	go func() {
-		for {
-			records, err := refreshRecords(cache)
-			if err != nil {
-				log.Printf("Failed to fetch prices: %v", err)
-				goto break_loop
-			} else {
-				// refresh the fuel stations' data
-				stations, err := updateStations()
-				if err != nil {
-					log.Printf("failed to update stations: %v", err)
-					goto break_loop
-				}
-				for _, record := range records {
-					var nome, tipo, comune, provincia, bandiera string
-					station, ok := stations[record.IDImpianto]
-					if ok {
-						nome = station.Nome
-						tipo = string(station.Tipo)
-						comune = station.Comune
-						provincia = station.Provincia
-						bandiera = station.Bandiera
-					}
-					carburantiGauge.WithLabelValues(
-						strconv.FormatInt(int64(record.IDImpianto), 10), // IDImpianto
-						record.Carburante,                      // Carburante
-						strconv.FormatBool(record.SelfService), // SelfService
-						nome,                                   // Nome
-						tipo,                                   // Tipo
-						comune,                                 // Comune
-						provincia,                              // Provincia
-						bandiera,                               // Bandiera
-					).Set(record.Prezzo)
-				}
-			}
-		break_loop:
-			log.Printf("Sleeping for %s", *flagSleepInterval)
-			time.Sleep(*flagSleepInterval)
+	var instanceLabels prometheus.Labels
+	if *flagInstanceLabel != "" {
+		name, value, ok := strings.Cut(*flagInstanceLabel, "=")
+		if !ok || name == "" {
+			log.Fatalf("Invalid -instance-label %q: must be name=value", *flagInstanceLabel)
 		}
-	}()
-
-	http.Handle(*flagPath, promhttp.Handler())
-	log.Printf("Starting server on %s", *flagListen)
-	log.Fatal(http.ListenAndServe(*flagListen, nil))
-}
-
-type Record struct {
-	IDImpianto        int
-	Carburante        string
-	Prezzo            float64
-	SelfService       bool
-	DataComunicazione time.Time
-}
+		instanceLabels = prometheus.Labels{name: value}
+	}
 
-func refreshRecords(cache *Cache) ([]*Record, error) {
-	resp, err := http.Get(pricesCSVURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch prices: %w", err)
-	}
-	defer resp.Body.Close()
-	br := bufio.NewReader(resp.Body)
-	// skip the first two lines. This is a non-compliant CSV with a two-line
-	// header.
-	for i := 0; i < 2; i++ {
-		if _, _, err := br.ReadLine(); err != nil {
-			return nil, fmt.Errorf("failed to read line: %w", err)
+	referencePrices := make(map[string]float64)
+	for _, ref := range flagReferencePrices {
+		fuel, value, ok := strings.Cut(ref, "=")
+		price, err := strconv.ParseFloat(value, 64)
+		if !ok || fuel == "" || err != nil {
+			log.Fatalf("Invalid -reference-price %q: must be fuel=price", ref)
 		}
+		referencePrices[fuel] = price
 	}
-	r := csv.NewReader(br)
-	r.Comma = ';'
-	r.FieldsPerRecord = 5
-	var records []*Record
-	for {
-		items, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to read CSV record: %w", err)
-		}
-		record, err := parseRecord(items)
+
+	var pinnedKeys [][sha256.Size]byte
+	for _, s := range flagPinSHA256 {
+		pin, err := parsePin(s)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse record: %w", err)
+			log.Fatalf("Invalid -pin-sha256 %q: %v", s, err)
 		}
-		records = append(records, record)
-		k := fmt.Sprintf("%d-%d", record.IDImpianto, record.DataComunicazione.Unix())
-		cache.Put(k, *record)
+		pinnedKeys = append(pinnedKeys, pin)
 	}
-	return records, nil
-}
 
-func parseRecord(items []string) (*Record, error) {
-	if len(items) != 5 {
-		return nil, fmt.Errorf("expected 5 fields, got %d", len(items))
+	var auditLogger *slog.Logger
+	if *flagAuditStations {
+		// the audit trail is requested explicitly, so it is not subject
+		// to -log-level.
+		auditLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
 	}
-	var r Record
 
-	idImpianto, err := strconv.ParseInt(items[0], 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("IDImpianto is not a numeric string: %w", err)
-	}
-	r.IDImpianto = int(idImpianto)
-	r.Carburante = items[1]
-	r.Prezzo, err = strconv.ParseFloat(items[2], 64)
-	if err != nil {
-		return nil, fmt.Errorf("Prezzo is not a float string: %w", err)
+	var validators []NamedValidator
+	if *flagMinPrice > 0 {
+		validators = append(validators, minPriceValidator(*flagMinPrice))
 	}
-	r.SelfService, err = strconv.ParseBool(items[3])
-	if err != nil {
-		return nil, fmt.Errorf("SelfService is not a bool string: %w", err)
+	if *flagMaxPrice > 0 {
+		validators = append(validators, maxPriceValidator(*flagMaxPrice))
 	}
-	r.DataComunicazione, err = time.Parse("2/1/2006 15:04:05", items[4])
+
+	e, err := NewExporter(Config{
+		PricesURL:          *flagPricesURL,
+		StationsURL:        *flagStationsURL,
+		PricesFile:         *flagPricesFile,
+		StationsFile:       *flagStationsFile,
+		StationsSchema:     stationsSchema,
+		Validators:         validators,
+		CacheTTL:           *flagCacheTTL,
+		UseReportTimestamp: *flagUseReportTime,
+		MaxSampleAge:       *flagMaxSampleAge,
+		DropOrphans:        *flagDropOrphans,
+		DecimalSeparator:   *flagDecimalSep,
+		Interval:           *flagSleepInterval,
+		StationsInterval:   *flagStationsInterval,
+		RefreshOnScrape:    *flagRefreshOnScrape,
+		MinRefreshInterval: *flagMinRefreshInterval,
+		AggregatesOnScrape: *flagAggregatesOnScrape,
+		Pushgateway:        *flagPushgateway,
+		PushgatewayJob:     *flagPushgatewayJob,
+		InfluxURL:          *flagInfluxURL,
+		MaxRetryAfter:      *flagMaxRetryAfter,
+		ActiveOnly:         *flagActiveOnly,
+		StaleAfter:         *flagStaleAfter,
+		ASCIILabels:        *flagASCIILabels,
+		SplitFuelMetrics:   *flagSplitFuelMetrics,
+		CacheDir:           *flagCacheDir,
+		GeoPrecision:       *flagGeoPrecision,
+		PricePrecision:     *flagPricePrecision,
+		MinSamples:         *flagMinSamples,
+		APICacheTTL:        *flagAPICacheTTL,
+		RegionCheapest:     *flagRegionCheapest,
+		ForceHTTP1:         *flagForceHTTP1,
+		DNSServer:          *flagDNSServer,
+		PinnedKeys:         pinnedKeys,
+		ThroughputDecay:    *flagThroughputDecay,
+		HTTPTimeout:        *flagHTTPTimeout,
+		RetryAttempts:      *flagRetryAttempts,
+		RetryBaseDelay:     *flagRetryBaseDelay,
+		InstanceLabels:     instanceLabels,
+		AuditLogger:        auditLogger,
+		HealthMaxAge:       *flagHealthMaxAge,
+		DeltaTokenTTL:      *flagDeltaTokenTTL,
+		DeltaMaxTokens:     *flagDeltaMaxTokens,
+		ReferencePrices:    referencePrices,
+		Filter: Filter{
+			Provinces:        splitList(*flagProvince),
+			Carburanti:       splitList(*flagCarburante),
+			ExcludeProvinces: flagExcludeProvinces,
+			ExcludeComuni:    flagExcludeComuni,
+		},
+	})
 	if err != nil {
-		return nil, fmt.Errorf("DataComunicazione is not a time string: %w", err)
+		log.Fatalf("Failed to create exporter: %v", err)
 	}
 
-	return &r, nil
-}
-
-type Station struct {
-	ID        int
-	Gestore   string
-	Bandiera  string
-	Tipo      StationType
-	Nome      string
-	Indirizzo string
-	Comune    string
-	Provincia string
-	Lat       string
-	Long      string
-}
-
-type StationType string
-
-const (
-	StationTypeStradale     = "Stradale"
-	StationTypeAutostradale = "Autostradale"
-)
-
-func updateStations() (map[int]Station, error) {
-	log.Printf("Updating stations from %q", stationsCSVURL)
-	resp, err := http.Get(stationsCSVURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch station data: %w", err)
-	}
-	defer resp.Body.Close()
-	br := bufio.NewReader(resp.Body)
-	// skip the first two lines. This is a non-compliant CSV with a two-line
-	// header.
-	stationMap := make(map[int]Station)
-	scanner := bufio.NewScanner(br)
-	lineno := 1
-	for scanner.Scan() {
-		// cannot use the csv package because the input CSV is malformed (unterminated quotes)
-		// and the csv package doesn't deal with that.
-		if lineno == 1 {
-			// skip header
-			continue
+	if *flagDumpRecords > 0 {
+		if err := e.DumpRecords(context.Background(), os.Stdout, *flagDumpRecords); err != nil {
+			log.Fatalf("Failed to dump records: %v", err)
 		}
-		line := scanner.Text()
-		items := strings.Split(line, ";")
-		if len(items) == 0 {
-			log.Printf("Warning: skipping empty line")
-			continue
+		return
+	}
+
+	if err := e.WarmUp(); err != nil {
+		log.Printf("Not warming up from the cache directory: %v", err)
+	}
+	// the refreshes are stopped only once the HTTP server is drained, so
+	// that in-flight requests are served from a live exporter.
+	runCtx, stopRun := context.WithCancel(context.Background())
+	defer stopRun()
+	e.StartJanitors(runCtx)
+	if *flagRefreshOnScrape {
+		log.Printf("Refreshing on scrape, at most every %s", *flagMinRefreshInterval)
+	} else {
+		// do not serve empty metrics until the first refresh, unless
+		// there is cached data to serve.
+		if err := e.Start(runCtx, *flagInitialAttempts); err != nil {
+			log.Fatalf("Initial refresh failed: %v", err)
 		}
-		idImpianto, err := strconv.ParseInt(items[0], 10, 64)
+	}
+
+	http.Handle(*flagPath, e.Handler())
+	aggregatesPath := strings.TrimSuffix(*flagPath, "/") + "/aggregates"
+	http.Handle(aggregatesPath, e.AggregatesHandler())
+	deltaPath := strings.TrimSuffix(*flagPath, "/") + "/delta"
+	http.Handle(deltaPath, e.DeltaHandler())
+	if *flagTenants != "" {
+		tenants, err := loadTenants(*flagTenants)
 		if err != nil {
-			return nil, fmt.Errorf("IDImpianto is not a numeric string: %w", err)
-		}
-		_, ok := stationMap[int(idImpianto)]
-		if ok {
-			log.Printf("Warning: found duplicate type '%s' for station ID %d, using the latest value", items[3], idImpianto)
-		}
-		address := ""
-		switch len(items) {
-		case 10:
-			address = items[5]
-		case 11:
-			// there is a bug in the data source, where the items can be 11 instead of 10.
-			// The extra field is a second version of the address, so we concatenate it to
-			// `Indirizzo`.
-			address = strings.Join(items[5:6], " | ")
-		default:
-			return nil, fmt.Errorf("malformed line with %d fields instead of 10 or 11: %q", len(items), items)
+			log.Fatalf("Failed to load tenants: %v", err)
 		}
-		stationMap[int(idImpianto)] = Station{
-			ID:        int(idImpianto),
-			Gestore:   items[1],
-			Bandiera:  items[2],
-			Tipo:      StationType(items[3]),
-			Nome:      items[4],
-			Indirizzo: address,
-			Comune:    items[6],
-			Provincia: items[7],
-			Lat:       items[8],
-			Long:      items[9],
+		for _, t := range tenants {
+			if t.Path == *flagPath || t.Path == aggregatesPath || t.Path == deltaPath {
+				log.Fatalf("Tenant path %q conflicts with the metrics path", t.Path)
+			}
+			h, err := e.TenantHandler(t)
+			if err != nil {
+				log.Fatalf("Failed to create tenant handler: %v", err)
+			}
+			http.Handle(t.Path, h)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to scan stations CSV: %w", err)
+	e.HandleAPI(http.DefaultServeMux)
+	e.HandleHealth(http.DefaultServeMux)
+	e.HandleAdmin(http.DefaultServeMux)
+	server := &http.Server{
+		Addr:    *flagListen,
+		Handler: accessLog(logger, http.DefaultServeMux),
+	}
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	ln, err := net.Listen("tcp", *flagListen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *flagListen, err)
+	}
+	log.Printf("Starting server on %s", *flagListen)
+	if err := serve(signalCtx, server, ln, *flagShutdownGrace); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve serves HTTP requests on `ln` until the context is cancelled, then
+// stops accepting new connections and waits up to `grace` for the in-flight
+// requests to complete.
+func serve(ctx context.Context, server *http.Server, ln net.Listener, grace time.Duration) error {
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		log.Printf("Shutting down, waiting up to %s for in-flight requests", grace)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to drain HTTP requests: %v", err)
+		}
+	}()
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		return err
 	}
-	return stationMap, nil
+	// Serve returns as soon as Shutdown is called, wait for the draining
+	// to complete.
+	<-drained
+	return nil
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- serve(ctx, &http.Server{Handler: mux}, ln, 5*time.Second) }()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/api/slow")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		responses <- response{body: string(b), err: err}
+	}()
+	<-started
+	cancel()
+	if r := <-responses; r.err != nil || r.body != "done" {
+		t.Errorf("got %q, %v for the in-flight request, want it to complete", r.body, r.err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve failed: %v", err)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"RM", []string{"RM"}},
+		{"RM, MI,,NA ", []string{"RM", "MI", "NA"}},
+	} {
+		if got := splitList(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitList(%q): got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestURLFlags(t *testing.T) {
+	if got := flag.Lookup("prices-url").DefValue; got != pricesCSVURL {
+		t.Errorf("got default prices URL %q, want %q", got, pricesCSVURL)
+	}
+	if got := flag.Lookup("stations-url").DefValue; got != stationsCSVURL {
+		t.Errorf("got default stations URL %q, want %q", got, stationsCSVURL)
+	}
+
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	defer func() {
+		flag.Set("prices-url", pricesCSVURL)
+		flag.Set("stations-url", stationsCSVURL)
+	}()
+	if err := flag.Set("prices-url", srv.URL+"/prices"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("stations-url", srv.URL+"/stations"); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewExporter(Config{PricesURL: *flagPricesURL, StationsURL: *flagStationsURL, RetryAttempts: 1})
+	if err != nil {
+		t.Fatalf("NewExporter failed: %v", err)
+	}
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh from the configured URLs failed: %v", err)
+	}
+	if got := len(e.store.Snapshot().Records); got != 3 {
+		t.Errorf("got %d records, want 3", got)
+	}
+}
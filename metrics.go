@@ -0,0 +1,558 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const priceHelp = "Fuel prices from Osservatorio Carburanti from MISE"
+
+var priceLabels = []string{"IDImpianto", "Carburante", "SelfService", "Nome", "Tipo", "Comune", "Provincia", "Bandiera"}
+
+// Values of the `disposition` label of the rows metric.
+const (
+	dispositionEmitted  = "emitted"
+	dispositionFiltered = "filtered"
+	dispositionError    = "error"
+	dispositionDedup    = "dedup"
+)
+
+// metrics holds all the metrics exported by an Exporter.
+type metrics struct {
+	servedOnly            *prometheus.GaugeVec
+	distinctBrands        *prometheus.GaugeVec
+	stdDev                *prometheus.GaugeVec
+	density               *prometheus.GaugeVec
+	selfSavings           *prometheus.GaugeVec
+	regionNewest          *prometheus.GaugeVec
+	autostradaleRatio     *prometheus.GaugeVec
+	reportsPerHour        *prometheus.GaugeVec
+	nearestCompetitor     *prometheus.HistogramVec
+	duplicateRows         prometheus.Gauge
+	stationsAdded         prometheus.Gauge
+	stationsRemoved       prometheus.Gauge
+	oldSamples            prometheus.Counter
+	invalidRecords        *prometheus.CounterVec
+	schemaMismatches      prometheus.Counter
+	truncatedDownloads    prometheus.Counter
+	downloadBytes         *prometheus.GaugeVec
+	decompressionRatio    *prometheus.GaugeVec
+	pushErrors            prometheus.Counter
+	influxErrors          prometheus.Counter
+	cacheHitAge           prometheus.Histogram
+	rateLimited           prometheus.Counter
+	refreshAlloc          prometheus.Gauge
+	rows                  *prometheus.CounterVec
+	conflictingStations   prometheus.Counter
+	stationInfo           *prometheus.Desc
+	reportedRatio         prometheus.Gauge
+	lowSampleFuels        prometheus.Gauge
+	regionCheapest        *prometheus.GaugeVec
+	httpProtocol          *prometheus.GaugeVec
+	parseThroughput       prometheus.Gauge
+	parseErrors           prometheus.Counter
+	lastFileRows          *prometheus.GaugeVec
+	lastFileBytes         *prometheus.GaugeVec
+	autostradaleSurcharge *prometheus.GaugeVec
+	stationsByRecency     *prometheus.GaugeVec
+	lastSuccess           prometheus.Gauge
+	maxRefreshDuration    prometheus.Gauge
+	fetchErrors           *prometheus.CounterVec
+	unexpectedPrecision   prometheus.Counter
+	price7dAvg            *prometheus.Desc
+	nationalAverage       *prometheus.GaugeVec
+	priceVsReference      *prometheus.Desc
+	dnsErrors             prometheus.Counter
+	emptyProvinces        prometheus.Gauge
+	fuelCatalog           *prometheus.GaugeVec
+	badTimestamps         prometheus.Counter
+	fuelPrevalence        *prometheus.GaugeVec
+	priceMin              *prometheus.GaugeVec
+	priceMax              *prometheus.GaugeVec
+	priceAvg              *prometheus.GaugeVec
+	priceAge              *prometheus.Desc
+	pinMismatches         prometheus.Counter
+	stationsSource        prometheus.Gauge
+	stationsLoaded        prometheus.Gauge
+	recordsLoaded         prometheus.Gauge
+
+	// catalog lists all the metrics above, and the ones created by the
+	// Exporter through it.
+	catalog *catalog
+}
+
+// aggregates returns the low-cardinality metrics, summarizing the prices
+// rather than exporting one series per station.
+func (m *metrics) aggregates() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.nationalAverage,
+		m.servedOnly,
+		m.distinctBrands,
+		m.stdDev,
+		m.density,
+		m.selfSavings,
+		m.regionNewest,
+		m.regionCheapest,
+		m.autostradaleRatio,
+		m.autostradaleSurcharge,
+		m.reportsPerHour,
+		m.nearestCompetitor,
+		m.reportedRatio,
+		m.stationsByRecency,
+		m.emptyProvinces,
+		m.fuelCatalog,
+		m.fuelPrevalence,
+		m.priceMin,
+		m.priceMax,
+		m.priceAvg,
+		m.lowSampleFuels,
+		m.lastSuccess,
+	}
+}
+
+// newMetrics creates all the exported metrics and registers them with `reg`.
+// The per-station metrics are only described, they are exported by
+// snapshotCollectors, see Exporter.snapshotCollectors.
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	c := &catalog{}
+	// the prices are exported by a priceCollector, see
+	// Exporter.newPriceCollector.
+	c.add("osservatorio_carburanti_price", priceHelp, "gauge", priceLabels)
+	m := metrics{
+		catalog: c,
+		servedOnly: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_served_only_stations_total",
+				Help: "Number of stations reporting only served (non self-service) prices, per province",
+			},
+			[]string{"Provincia"},
+		),
+		distinctBrands: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_distinct_brands_per_province",
+				Help: "Number of distinct station brands, per province",
+			},
+			[]string{"Provincia"},
+		),
+		stdDev: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_price_stddev",
+				Help: "Standard deviation of fuel prices, per fuel type and province",
+			},
+			[]string{"Carburante", "Provincia"},
+		),
+		density: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_station_density",
+				Help: "Number of stations per 100k residents, per region",
+			},
+			[]string{"Regione"},
+		),
+		selfSavings: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_avg_self_service_savings",
+				Help: "Average difference between served and self-service prices, over the stations reporting both, per province and fuel type",
+			},
+			[]string{"Provincia", "Carburante"},
+		),
+		regionNewest: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_region_newest_report_timestamp_seconds",
+				Help: "Unix timestamp of the most recent price report, per region",
+			},
+			[]string{"Regione"},
+		),
+		autostradaleRatio: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_autostradale_ratio",
+				Help: "Fraction of stations on a motorway (Autostradale), per region",
+			},
+			[]string{"Regione"},
+		),
+		reportsPerHour: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_reports_per_hour",
+				Help: "Number of price reports in the last 24 hours, per hour of the day",
+			},
+			[]string{"hour"},
+		),
+		nearestCompetitor: c.histogramVec(
+			prometheus.HistogramOpts{
+				Name:    "osservatorio_carburanti_nearest_competitor_km",
+				Help:    "Distribution of the distance in kilometers between each station and the nearest other station",
+				Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 50},
+			},
+			nil,
+		),
+		duplicateRows: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_duplicate_price_rows_total",
+				Help: "Number of rows in the last prices file that are exact duplicates of another row",
+			},
+		),
+		stationsAdded: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_stations_added_24h",
+				Help: "Number of stations added in the last 24 hours",
+			},
+		),
+		stationsRemoved: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_stations_removed_24h",
+				Help: "Number of stations removed in the last 24 hours",
+			},
+		),
+		oldSamples: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_old_sample_timestamps_total",
+				Help: "Number of price samples older than -max-sample-age, exported with the current time instead of their report time",
+			},
+		),
+		invalidRecords: c.counterVec(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_invalid_records_total",
+				Help: "Number of price records dropped by validation, per validator",
+			},
+			[]string{"validator"},
+		),
+		schemaMismatches: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_schema_mismatches_total",
+				Help: "Number of prices downloads discarded because their layout does not match the expected one",
+			},
+		),
+		truncatedDownloads: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_truncated_downloads_total",
+				Help: "Number of prices downloads discarded because truncated",
+			},
+		),
+		downloadBytes: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_download_bytes",
+				Help: "Size in bytes of the last downloaded file as transferred, i.e. compressed if the server compressed it, per source",
+			},
+			[]string{"source"},
+		),
+		decompressionRatio: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_decompression_ratio",
+				Help: "Ratio between the decompressed and the compressed size of the last downloaded file, per source. 1 if not compressed",
+			},
+			[]string{"source"},
+		),
+		pushErrors: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_push_errors_total",
+				Help: "Number of failed pushes to the Pushgateway",
+			},
+		),
+		influxErrors: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_influx_push_errors_total",
+				Help: "Number of failed pushes to InfluxDB",
+			},
+		),
+		cacheHitAge: c.histogram(
+			prometheus.HistogramOpts{
+				Name: "osservatorio_carburanti_cache_hit_age_seconds",
+				Help: "Age of the cache entries returned as hits, useful to tune -cache-ttl",
+				// from one minute to about eight hours
+				Buckets: prometheus.ExponentialBuckets(60, 2, 10),
+			},
+		),
+		rateLimited: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_rate_limited_total",
+				Help: "Number of downloads rejected with 429 Too Many Requests",
+			},
+		),
+		refreshAlloc: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_refresh_alloc_bytes",
+				Help: "Bytes allocated by the process during the last successful refresh, including concurrent allocations, such as scrapes",
+			},
+		),
+		rows: c.counterVec(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_rows_total",
+				Help: "Number of price rows read, by what happened to them: emitted as a series, filtered out, failed to parse, or superseded by a row with the same labels",
+			},
+			[]string{"disposition"},
+		),
+		conflictingStations: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_conflicting_duplicate_stations_total",
+				Help: "Number of station IDs found more than once with different values in the stations file",
+			},
+		),
+		stationInfo: c.desc(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_station_info",
+				Help: "Metadata of the stations, with their original values, always 1",
+			},
+			[]string{"IDImpianto", "Gestore", "Bandiera", "Tipo", "Nome", "Indirizzo", "Comune", "Provincia", "Lat", "Long"},
+		),
+		reportedRatio: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_reported_prices_ratio",
+				Help: "Fraction of prices reported by the stations, as opposed to carried over from a previous report",
+			},
+		),
+		lowSampleFuels: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_low_sample_fuels_total",
+				Help: "Number of fuel type and province pairs with fewer prices than -min-samples, whose statistics are not exported",
+			},
+		),
+		regionCheapest: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_region_cheapest_price",
+				Help: "Lowest price per region and fuel type, with -region-cheapest",
+			},
+			[]string{"Regione", "Carburante"},
+		),
+		httpProtocol: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_http_protocol",
+				Help: "HTTP protocol used by the last download of each source, always 1",
+			},
+			[]string{"source", "protocol"},
+		),
+		parseThroughput: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_parse_throughput_ewma",
+				Help: "Exponentially weighted moving average of the price records downloaded and parsed per second, see -throughput-decay",
+			},
+		),
+		parseErrors: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_parse_errors_total",
+				Help: "Number of malformed price rows skipped",
+			},
+		),
+		lastFileRows: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_last_file_rows",
+				Help: "Number of data rows of the last successfully parsed file, per source",
+			},
+			[]string{"source"},
+		),
+		lastFileBytes: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_last_file_bytes",
+				Help: "Size in bytes of the last successfully parsed file, decompressed, per source, updated together with osservatorio_carburanti_last_file_rows",
+			},
+			[]string{"source"},
+		),
+		autostradaleSurcharge: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_autostradale_surcharge",
+				Help: "National average price at motorway stations minus the one at the other stations, per fuel type",
+			},
+			[]string{"Carburante"},
+		),
+		stationsByRecency: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_stations_by_recency",
+				Help: "Number of stations by age of their latest price report",
+			},
+			[]string{"bucket"},
+		),
+		lastSuccess: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_last_success_timestamp_seconds",
+				Help: "Time of the last successful refresh",
+			},
+		),
+		maxRefreshDuration: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_max_refresh_duration_seconds",
+				Help: "Duration of the longest refresh since startup or since the last reset",
+			},
+		),
+		fetchErrors: c.counterVec(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_fetch_errors_total",
+				Help: "Number of failed fetches during a refresh, per source",
+			},
+			[]string{"source"},
+		),
+		unexpectedPrecision: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_unexpected_price_precision_total",
+				Help: "Number of parsed prices whose number of decimals differs from the configured price precision",
+			},
+		),
+		price7dAvg: c.desc(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_price_7d_avg",
+				Help: "Average of the prices reported in the last 7 days, including the one in force 7 days ago",
+			},
+			[]string{"IDImpianto", "Carburante", "SelfService"},
+		),
+		nationalAverage: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_national_average_price",
+				Help: "National average price, per fuel type",
+			},
+			[]string{"Carburante"},
+		),
+		priceVsReference: c.desc(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_price_vs_reference",
+				Help: "Price minus the configured reference price of the fuel type",
+			},
+			[]string{"IDImpianto", "Carburante", "SelfService"},
+		),
+		dnsErrors: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_dns_errors_total",
+				Help: "Number of download attempts failed resolving the host",
+			},
+		),
+		emptyProvinces: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_empty_provinces_total",
+				Help: "Number of provinces without any price",
+			},
+		),
+		fuelCatalog: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_fuel_catalog_info",
+				Help: "Always 1 for each canonical fuel type with prices, with an example of its names as reported",
+			},
+			[]string{"canonical", "example"},
+		),
+		badTimestamps: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_bad_timestamp_total",
+				Help: "Number of parsed prices kept without their invalid report time",
+			},
+		),
+		fuelPrevalence: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_fuel_prevalence",
+				Help: "Ratio of the stations with a price for the fuel type to all the stations",
+			},
+			[]string{"Carburante"},
+		),
+		priceMin: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_price_min",
+				Help: "Minimum price, per province and fuel type",
+			},
+			[]string{"Provincia", "Carburante"},
+		),
+		priceMax: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_price_max",
+				Help: "Maximum price, per province and fuel type",
+			},
+			[]string{"Provincia", "Carburante"},
+		),
+		priceAvg: c.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_price_avg",
+				Help: "Average price, per province and fuel type",
+			},
+			[]string{"Provincia", "Carburante"},
+		),
+		priceAge: c.desc(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_price_age_seconds",
+				Help: "Time since the price was reported by the station",
+			},
+			priceLabels,
+		),
+		pinMismatches: c.counter(
+			prometheus.CounterOpts{
+				Name: "osservatorio_carburanti_tls_pin_mismatches_total",
+				Help: "Number of connections rejected because the server's certificate did not match any of the pinned keys",
+			},
+		),
+		stationsSource: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_stations_source",
+				Help: "Where the stations of the last refresh came from: 0 if downloaded, 1 if reused from a previous download",
+			},
+		),
+		stationsLoaded: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_stations_loaded",
+				Help: "Number of stations parsed from the last downloaded stations file",
+			},
+		),
+		recordsLoaded: c.gauge(
+			prometheus.GaugeOpts{
+				Name: "osservatorio_carburanti_records_loaded",
+				Help: "Number of price records parsed from the last downloaded prices file",
+			},
+		),
+	}
+	for _, c := range []prometheus.Collector{
+		m.servedOnly,
+		m.distinctBrands,
+		m.stdDev,
+		m.density,
+		m.selfSavings,
+		m.regionNewest,
+		m.autostradaleRatio,
+		m.reportsPerHour,
+		m.nearestCompetitor,
+		m.duplicateRows,
+		m.stationsAdded,
+		m.stationsRemoved,
+		m.oldSamples,
+		m.invalidRecords,
+		m.schemaMismatches,
+		m.truncatedDownloads,
+		m.downloadBytes,
+		m.decompressionRatio,
+		m.pushErrors,
+		m.influxErrors,
+		m.cacheHitAge,
+		m.rateLimited,
+		m.refreshAlloc,
+		m.rows,
+		m.conflictingStations,
+		m.reportedRatio,
+		m.lowSampleFuels,
+		m.regionCheapest,
+		m.httpProtocol,
+		m.parseThroughput,
+		m.parseErrors,
+		m.lastFileRows,
+		m.lastFileBytes,
+		m.autostradaleSurcharge,
+		m.stationsByRecency,
+		m.lastSuccess,
+		m.maxRefreshDuration,
+		m.fetchErrors,
+		m.unexpectedPrecision,
+		m.nationalAverage,
+		m.dnsErrors,
+		m.emptyProvinces,
+		m.fuelCatalog,
+		m.badTimestamps,
+		m.fuelPrevalence,
+		m.priceMin,
+		m.priceMax,
+		m.priceAvg,
+		m.pinMismatches,
+		m.stationsSource,
+		m.stationsLoaded,
+		m.recordsLoaded,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metric: %w", err)
+		}
+	}
+	// export the fetch errors of both sources from the start, so that their
+	// rate is defined before the first failure.
+	for _, source := range []string{sourcePrices, sourceStations} {
+		m.fetchErrors.WithLabelValues(source)
+	}
+	return &m, nil
+}
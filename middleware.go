@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// statusRecorder is an http.ResponseWriter that remembers the status code
+// written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// accessLog wraps an http.Handler, assigning a request ID to every request and
+// logging method, path, status, duration and remote address once it has been
+// served. A request ID sent by the client is reused. The request ID is echoed
+// back in the `X-Request-Id` response header.
+// Successful requests are logged at info level, client errors at warning
+// level and server errors at error level, so `-log-level` controls how
+// verbose the access log is.
+func accessLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+		logger.Log(r.Context(), level, "HTTP request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+// refreshOnScrape wraps a metrics handler so that every request first calls
+// `refresh`, which is expected to rate-limit the actual refreshes. If the
+// refresh fails, the previously collected metrics are served.
+func refreshOnScrape(next http.Handler, refresh func(context.Context) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := refresh(r.Context()); err != nil {
+			log.Printf("Refresh failed: %v", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
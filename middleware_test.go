@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	h := accessLog(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	w := scrape(t, h, "/api/prices")
+	id := w.Header().Get(requestIDHeader)
+	if id == "" {
+		t.Fatalf("%s header not set", requestIDHeader)
+	}
+	line := buf.String()
+	for _, want := range []string{"request_id=" + id, "method=GET", "path=/api/prices", "status=418", "duration="} {
+		if !strings.Contains(line, want) {
+			t.Errorf("access log %q does not contain %q", line, want)
+		}
+	}
+}
+
+func TestAccessLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	status := http.StatusOK
+	h := accessLog(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	scrape(t, h, "/")
+	if buf.Len() != 0 {
+		t.Errorf("successful request logged at warning level: %q", buf.String())
+	}
+	status = http.StatusNotFound
+	scrape(t, h, "/")
+	if !strings.Contains(buf.String(), "level=WARN") {
+		t.Errorf("client error not logged at warning level: %q", buf.String())
+	}
+}
+
+func TestAccessLogReusesRequestID(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	h := accessLog(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(requestIDHeader, "abc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get(requestIDHeader); got != "abc" {
+		t.Errorf("got request ID %q, want %q", got, "abc")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	// the report times are parsed in reportLocation, wherever this runs.
+	_ "time/tzdata"
+)
+
+// reportLocation is the time zone of the report times, that MIMIT publishes
+// in Italian local time.
+var reportLocation = mustLoadLocation("Europe/Rome")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+type Record struct {
+	IDImpianto        int
+	Carburante        string
+	Prezzo            float64
+	SelfService       bool
+	DataComunicazione time.Time
+	// Reported is false for prices carried over from a previous report
+	// rather than reported by the station. The MIMIT files do not tell them
+	// apart yet, so it is always true.
+	Reported bool
+}
+
+// errTruncated is returned when the prices file ends with an incomplete row,
+// which usually means that the download was interrupted.
+var errTruncated = errors.New("prices file is truncated")
+
+// lastByteReader remembers the last byte read from the wrapped reader.
+type lastByteReader struct {
+	r    io.Reader
+	last byte
+}
+
+func (l *lastByteReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.last = p[n-1]
+	}
+	return n, err
+}
+
+// pricesFields is the number of fields of every row of the prices CSV file.
+const pricesFields = 5
+
+// The schema of the prices file is checked against the first
+// schemaSampleRows rows: if more than schemaMismatchThreshold of them do not
+// have the expected number of fields, errSchemaMismatch is returned.
+const (
+	schemaSampleRows        = 100
+	schemaMismatchThreshold = 0.5
+)
+
+// errBadTimestamp is returned, together with the record, when a price row
+// has an invalid report time. The record has a zero DataComunicazione.
+var errBadTimestamp = errors.New("bad report time")
+
+// errSchemaMismatch is returned when the layout of the prices file does not
+// match the expected one, e.g. when MIMIT adds a column.
+var errSchemaMismatch = errors.New("prices file schema mismatch")
+
+// csvRow is a row returned by csv.Reader.Read, with its error.
+type csvRow struct {
+	items []string
+	err   error
+}
+
+// checkSchema returns errSchemaMismatch if too many of the sample rows have
+// an unexpected number of fields.
+func checkSchema(sample []csvRow) error {
+	if len(sample) == 0 {
+		return nil
+	}
+	mismatches := 0
+	for _, row := range sample {
+		if row.err == nil && len(row.items) != pricesFields {
+			mismatches++
+		}
+	}
+	if float64(mismatches) > schemaMismatchThreshold*float64(len(sample)) {
+		return fmt.Errorf("%w: %d of the first %d rows do not have %d fields", errSchemaMismatch, mismatches, len(sample), pricesFields)
+	}
+	return nil
+}
+
+// pricesStats are statistics collected while parsing a prices CSV file.
+type pricesStats struct {
+	// Skipped is the number of malformed rows skipped.
+	Skipped int
+	// BadTimestamps is the number of rows kept without their invalid
+	// report time.
+	BadTimestamps int
+	// Decimals counts the parsed prices by their number of decimals, as
+	// written in the file.
+	Decimals map[int]int
+}
+
+// parseRecords parses a prices CSV file, and returns the parsed records and
+// statistics about them. If the last row is incomplete and not terminated by
+// a newline, errTruncated is returned. If the rows do not have the expected
+// number of fields, errSchemaMismatch is returned.
+func parseRecords(rd io.Reader) ([]*Record, pricesStats, error) {
+	lr := &lastByteReader{r: rd}
+	br := bufio.NewReader(lr)
+	// skip the first two lines. This is a non-compliant CSV with a two-line
+	// header.
+	for i := 0; i < 2; i++ {
+		if _, _, err := br.ReadLine(); err != nil {
+			return nil, pricesStats{}, fmt.Errorf("failed to read line: %w", err)
+		}
+	}
+	r := csv.NewReader(br)
+	r.Comma = ';'
+	// the number of fields is checked by checkSchema and parseRecord.
+	r.FieldsPerRecord = -1
+	var sample []csvRow
+	for len(sample) < schemaSampleRows {
+		items, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		sample = append(sample, csvRow{items: items, err: err})
+	}
+	if err := checkSchema(sample); err != nil {
+		return nil, pricesStats{}, err
+	}
+	// read returns the sampled rows first, then the rest of the file.
+	read := func() ([]string, error) {
+		if len(sample) > 0 {
+			row := sample[0]
+			sample = sample[1:]
+			return row.items, row.err
+		}
+		return r.Read()
+	}
+	var records []*Record
+	stats := pricesStats{Decimals: make(map[int]int)}
+	items, err := read()
+	for err != io.EOF {
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			// the reader cannot go past an I/O error.
+			return nil, stats, fmt.Errorf("failed to read prices: %w", err)
+		}
+		var record *Record
+		if err == nil {
+			record, err = parseRecord(items)
+		}
+		nextItems, nextErr := read()
+		// a bad row is a truncation if it is the last one and it is not
+		// terminated by a newline. This includes a bad report time, that
+		// may have been cut.
+		truncated := nextErr == io.EOF && lr.last != '\n'
+		if errors.Is(err, errBadTimestamp) && !truncated {
+			// the price is still valid.
+			log.Printf("Warning: keeping price row %q without its report time: %v", items, err)
+			stats.BadTimestamps++
+			err = nil
+		}
+		if err != nil {
+			if truncated {
+				return nil, stats, fmt.Errorf("%w: incomplete last row %q", errTruncated, items)
+			}
+			// a single bad row must not discard all the others.
+			log.Printf("Warning: skipping malformed price row %q: %v", items, err)
+			stats.Skipped++
+		} else {
+			records = append(records, record)
+			stats.Decimals[priceDecimals(items[2])]++
+		}
+		items, err = nextItems, nextErr
+	}
+	return records, stats, nil
+}
+
+func parseRecord(items []string) (*Record, error) {
+	if len(items) != pricesFields {
+		return nil, fmt.Errorf("expected %d fields, got %d", pricesFields, len(items))
+	}
+	var r Record
+
+	// a byte order mark may end up in front of the first data row.
+	idImpianto, err := strconv.ParseInt(strings.TrimPrefix(items[0], "\ufeff"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("IDImpianto is not a numeric string: %w", err)
+	}
+	r.IDImpianto = int(idImpianto)
+	r.Carburante = items[1]
+	r.Prezzo, err = strconv.ParseFloat(items[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("Prezzo is not a float string: %w", err)
+	}
+	r.SelfService, err = strconv.ParseBool(items[3])
+	if err != nil {
+		return nil, fmt.Errorf("SelfService is not a bool string: %w", err)
+	}
+	r.Reported = true
+	r.DataComunicazione, err = time.ParseInLocation("2/1/2006 15:04:05", items[4], reportLocation)
+	if err != nil {
+		return &r, fmt.Errorf("%w: DataComunicazione is not a time string: %v", errBadTimestamp, err)
+	}
+
+	return &r, nil
+}
+
+// priceDecimals returns the number of decimals of a price as written in the
+// prices file.
+func priceDecimals(s string) int {
+	if _, decimals, ok := strings.Cut(s, "."); ok {
+		return len(decimals)
+	}
+	return 0
+}
+
+// roundPrice rounds a price to the given number of decimals. Prices are
+// returned unchanged if `decimals` is not positive.
+func roundPrice(price float64, decimals int) float64 {
+	if decimals <= 0 {
+		return price
+	}
+	scale := math.Pow10(decimals)
+	return math.Round(price*scale) / scale
+}
+
+// dedupeLatest returns the records keeping, for each station, fuel type and
+// service mode, only the one with the newest report time, or the last one in
+// the file if several have the same. The order of the records is preserved.
+func dedupeLatest(records []*Record) []*Record {
+	index := make(map[priceKey]int, len(records))
+	ret := make([]*Record, 0, len(records))
+	for _, record := range records {
+		k := priceKey{IDImpianto: record.IDImpianto, Carburante: record.Carburante, SelfService: record.SelfService}
+		i, ok := index[k]
+		if !ok {
+			index[k] = len(ret)
+			ret = append(ret, record)
+			continue
+		}
+		if !record.DataComunicazione.Before(ret[i].DataComunicazione) {
+			ret[i] = record
+		}
+	}
+	return ret
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRecordReportLocation(t *testing.T) {
+	for _, tt := range []struct {
+		dtComu string
+		want   time.Time
+	}{
+		// CEST, UTC+2
+		{"12/10/2023 08:00:00", time.Date(2023, 10, 12, 6, 0, 0, 0, time.UTC)},
+		// CET, UTC+1
+		{"12/01/2024 08:00:00", time.Date(2024, 1, 12, 7, 0, 0, 0, time.UTC)},
+	} {
+		record, err := parseRecord([]string{"1", "Benzina", "1.899", "1", tt.dtComu})
+		if err != nil {
+			t.Fatalf("parseRecord failed: %v", err)
+		}
+		if !record.DataComunicazione.Equal(tt.want) {
+			t.Errorf("got %v for %q, want %v", record.DataComunicazione.UTC(), tt.dtComu, tt.want)
+		}
+	}
+}
+
+func TestParseRecordsSchemaMismatch(t *testing.T) {
+	csv := `Estrazione del 2023-10-12
+idImpianto;descCarburante;prezzo;isSelf;dtComu;extra
+1;Benzina;1.899;1;12/10/2023 08:00:00;x
+1;Gasolio;1.799;0;12/10/2023 08:00:00;x
+2;Benzina;1.999;0;12/10/2023 09:00:00;x
+`
+	if _, _, err := parseRecords(strings.NewReader(csv)); !errors.Is(err, errSchemaMismatch) {
+		t.Errorf("got error %v, want %v", err, errSchemaMismatch)
+	}
+	if _, _, err := parseRecords(strings.NewReader(testPricesCSV)); err != nil {
+		t.Errorf("got error %v for the expected schema", err)
+	}
+}
+
+func TestParseRecordsSkipsMalformedRows(t *testing.T) {
+	csv := `Estrazione del 2023-10-12
+idImpianto;descCarburante;prezzo;isSelf;dtComu
+1;Benzina;1.899;1;12/10/2023 08:00:00
+2;Benzina;abc;0;12/10/2023 09:00:00
+`
+	records, stats, err := parseRecords(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("parseRecords failed: %v", err)
+	}
+	if len(records) != 1 || records[0].IDImpianto != 1 || records[0].Prezzo != 1.899 {
+		t.Errorf("got records %v, want only the good one", records)
+	}
+	if stats.Skipped != 1 {
+		t.Errorf("got %d skipped rows, want 1", stats.Skipped)
+	}
+}
+
+func TestParseRecordsBOM(t *testing.T) {
+	csv := "Estrazione del 2023-10-12\nidImpianto;descCarburante;prezzo;isSelf;dtComu\n\ufeff1;Benzina;1.899;1;12/10/2023 08:00:00\n"
+	records, _, err := parseRecords(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("parseRecords failed: %v", err)
+	}
+	if len(records) != 1 || records[0].IDImpianto != 1 || records[0].Prezzo != 1.899 {
+		t.Errorf("got records %v, want station 1 at 1.899", records)
+	}
+}
+
+func TestParseRecordsBadTimestamp(t *testing.T) {
+	const header = "Estrazione del 2023-10-12\nidImpianto;descCarburante;prezzo;isSelf;dtComu\n"
+	// the last row is terminated by a newline, so it is complete.
+	csv := header + "1;Benzina;1.899;1;12/10/2023 08:00:00\n2;Benzina;1.999;0;not a time\n"
+	records, stats, err := parseRecords(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("parseRecords failed: %v", err)
+	}
+	if len(records) != 2 || records[1].IDImpianto != 2 || records[1].Prezzo != 1.999 {
+		t.Fatalf("got records %v, want both", records)
+	}
+	if !records[1].DataComunicazione.IsZero() {
+		t.Errorf("got report time %v, want the zero time", records[1].DataComunicazione)
+	}
+	if stats.BadTimestamps != 1 || stats.Skipped != 0 {
+		t.Errorf("got %d bad timestamps and %d skipped rows, want 1 and 0", stats.BadTimestamps, stats.Skipped)
+	}
+
+	// a report time cut at the end of the file is a truncation.
+	csv = header + "1;Benzina;1.899;1;12/10/2023 08:00:00\n2;Benzina;1.999;0;12/10/20"
+	if _, _, err := parseRecords(strings.NewReader(csv)); !errors.Is(err, errTruncated) {
+		t.Errorf("got error %v, want %v", err, errTruncated)
+	}
+}
+
+func TestRefreshBadTimestamp(t *testing.T) {
+	prices := strings.Replace(testPricesCSV, "2;Benzina;1.999;0;12/10/2023 09:00:00", "2;Benzina;1.999;0;not a time", 1)
+	srv := newTestServer(t, prices, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got := testutil.ToFloat64(e.metrics.badTimestamps); got != 1 {
+		t.Errorf("got %v bad timestamps, want 1", got)
+	}
+	want := `osservatorio_carburanti_price{Bandiera="Q8",Carburante="Benzina",Comune="MILANO",IDImpianto="2",Nome="Q8 Milano",Provincia="MI",SelfService="false",Tipo="Autostradale"} 1.999`
+	if body := scrape(t, e.Handler(), "/metrics").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("the price with a bad report time is not exported, got:\n%s", body)
+	}
+}
+
+func TestDedupeLatest(t *testing.T) {
+	t0 := time.Date(2023, 10, 12, 8, 0, 0, 0, time.UTC)
+	older := &Record{IDImpianto: 1, Carburante: "Benzina", SelfService: true, Prezzo: 1.899, DataComunicazione: t0}
+	newer := &Record{IDImpianto: 1, Carburante: "Benzina", SelfService: true, Prezzo: 1.849, DataComunicazione: t0.Add(time.Hour)}
+	served := &Record{IDImpianto: 1, Carburante: "Benzina", SelfService: false, Prezzo: 1.999, DataComunicazione: t0}
+	sameTime := &Record{IDImpianto: 1, Carburante: "Benzina", SelfService: false, Prezzo: 2.009, DataComunicazione: t0}
+	for _, tt := range []struct {
+		name    string
+		records []*Record
+		want    []*Record
+	}{
+		{"newer last", []*Record{older, served, newer}, []*Record{newer, served}},
+		{"newer first", []*Record{newer, served, older}, []*Record{newer, served}},
+		// the last one in the file wins
+		{"same time", []*Record{served, sameTime}, []*Record{sameTime}},
+	} {
+		if got := dedupeLatest(tt.records); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// provinceRegions maps every province code (sigla) to its region.
+var provinceRegions = map[string]string{
+	"AQ": "Abruzzo", "CH": "Abruzzo", "PE": "Abruzzo", "TE": "Abruzzo",
+	"MT": "Basilicata", "PZ": "Basilicata",
+	"CS": "Calabria", "CZ": "Calabria", "KR": "Calabria", "RC": "Calabria", "VV": "Calabria",
+	"AV": "Campania", "BN": "Campania", "CE": "Campania", "NA": "Campania", "SA": "Campania",
+	"BO": "Emilia-Romagna", "FC": "Emilia-Romagna", "FE": "Emilia-Romagna", "MO": "Emilia-Romagna", "PC": "Emilia-Romagna",
+	"PR": "Emilia-Romagna", "RA": "Emilia-Romagna", "RE": "Emilia-Romagna", "RN": "Emilia-Romagna",
+	"GO": "Friuli-Venezia Giulia", "PN": "Friuli-Venezia Giulia", "TS": "Friuli-Venezia Giulia", "UD": "Friuli-Venezia Giulia",
+	"FR": "Lazio", "LT": "Lazio", "RI": "Lazio", "RM": "Lazio", "VT": "Lazio",
+	"GE": "Liguria", "IM": "Liguria", "SP": "Liguria", "SV": "Liguria",
+	"BG": "Lombardia", "BS": "Lombardia", "CO": "Lombardia", "CR": "Lombardia", "LC": "Lombardia", "LO": "Lombardia",
+	"MB": "Lombardia", "MI": "Lombardia", "MN": "Lombardia", "PV": "Lombardia", "SO": "Lombardia", "VA": "Lombardia",
+	"AN": "Marche", "AP": "Marche", "FM": "Marche", "MC": "Marche", "PU": "Marche",
+	"CB": "Molise", "IS": "Molise",
+	"AL": "Piemonte", "AT": "Piemonte", "BI": "Piemonte", "CN": "Piemonte", "NO": "Piemonte", "TO": "Piemonte",
+	"VB": "Piemonte", "VC": "Piemonte",
+	"BA": "Puglia", "BR": "Puglia", "BT": "Puglia", "FG": "Puglia", "LE": "Puglia", "TA": "Puglia",
+	"CA": "Sardegna", "NU": "Sardegna", "OR": "Sardegna", "SS": "Sardegna", "SU": "Sardegna",
+	"AG": "Sicilia", "CL": "Sicilia", "CT": "Sicilia", "EN": "Sicilia", "ME": "Sicilia", "PA": "Sicilia",
+	"RG": "Sicilia", "SR": "Sicilia", "TP": "Sicilia",
+	"AR": "Toscana", "FI": "Toscana", "GR": "Toscana", "LI": "Toscana", "LU": "Toscana", "MS": "Toscana",
+	"PI": "Toscana", "PO": "Toscana", "PT": "Toscana", "SI": "Toscana",
+	"BZ": "Trentino-Alto Adige", "TN": "Trentino-Alto Adige",
+	"PG": "Umbria", "TR": "Umbria",
+	"AO": "Valle d'Aosta",
+	"BL": "Veneto", "PD": "Veneto", "RO": "Veneto", "TV": "Veneto", "VE": "Veneto", "VI": "Veneto", "VR": "Veneto",
+}
+
+// regionPopulation is the resident population of each region, rounded to the
+// thousands, according to ISTAT as of January 1st, 2023.
+var regionPopulation = map[string]int{
+	"Abruzzo":               1272000,
+	"Basilicata":            537000,
+	"Calabria":              1846000,
+	"Campania":              5609000,
+	"Emilia-Romagna":        4455000,
+	"Friuli-Venezia Giulia": 1194000,
+	"Lazio":                 5715000,
+	"Liguria":               1507000,
+	"Lombardia":             9976000,
+	"Marche":                1487000,
+	"Molise":                290000,
+	"Piemonte":              4252000,
+	"Puglia":                3922000,
+	"Sardegna":              1578000,
+	"Sicilia":               4814000,
+	"Toscana":               3661000,
+	"Trentino-Alto Adige":   1077000,
+	"Umbria":                858000,
+	"Valle d'Aosta":         123000,
+	"Veneto":                4848000,
+}
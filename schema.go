@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// StationsSchema describes the column layout of a stations CSV file. Each
+// field holds the zero-based index of the corresponding column, or -1 if the
+// layout does not have it.
+type StationsSchema struct {
+	// Fields is the number of fields expected in every line.
+	Fields    int
+	ID        int
+	Gestore   int
+	Bandiera  int
+	Tipo      int
+	Nome      int
+	Indirizzo int
+	Comune    int
+	Provincia int
+	Lat       int
+	Long      int
+}
+
+// stationsSchemas lists the known layouts of the stations CSV file, by
+// version. Add a new entry here when MIMIT changes the layout, rather than
+// changing an existing one.
+var stationsSchemas = map[string]StationsSchema{
+	// idImpianto;Gestore;Bandiera;Tipo Impianto;Nome Impianto;Indirizzo;Comune;Provincia;Latitudine;Longitudine
+	"v1": {
+		Fields:    10,
+		ID:        0,
+		Gestore:   1,
+		Bandiera:  2,
+		Tipo:      3,
+		Nome:      4,
+		Indirizzo: 5,
+		Comune:    6,
+		Provincia: 7,
+		Lat:       8,
+		Long:      9,
+	},
+	// the older layout, without the name of the station:
+	// idImpianto;Gestore;Bandiera;Tipo Impianto;Indirizzo;Comune;Provincia;Latitudine;Longitudine
+	"v0": {
+		Fields:    9,
+		ID:        0,
+		Gestore:   1,
+		Bandiera:  2,
+		Tipo:      3,
+		Nome:      -1,
+		Indirizzo: 4,
+		Comune:    5,
+		Provincia: 6,
+		Lat:       7,
+		Long:      8,
+	},
+}
+
+const defaultStationsSchema = "v1"
+
+// column returns the field of `items` at index `i`, or an empty string if
+// the column is missing from the layout, i.e. `i` is negative.
+func column(items []string, i int) string {
+	if i < 0 {
+		return ""
+	}
+	return items[i]
+}
+
+// stationsSchemaByName returns the stations schema with the given version
+// name, or an error listing the known versions.
+func stationsSchemaByName(name string) (StationsSchema, error) {
+	schema, ok := stationsSchemas[name]
+	if !ok {
+		names := make([]string, 0, len(stationsSchemas))
+		for n := range stationsSchemas {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return StationsSchema{}, fmt.Errorf("unknown stations schema %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+	return schema, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStationsOlderSchema(t *testing.T) {
+	csv := `Estrazione del 2019-10-12
+idImpianto;Gestore;Bandiera;Tipo Impianto;Indirizzo;Comune;Provincia;Latitudine;Longitudine
+1;Gestore 1;Eni;Stradale;Via Roma 1;ROMA;RM;41.9;12.5
+`
+	schema, err := stationsSchemaByName("v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stations, _, err := parseStations(strings.NewReader(csv), schema)
+	if err != nil {
+		t.Fatalf("parseStations failed: %v", err)
+	}
+	want := Station{
+		ID:        1,
+		Gestore:   "Gestore 1",
+		Bandiera:  "Eni",
+		Tipo:      StationTypeStradale,
+		Indirizzo: "Via Roma 1",
+		Comune:    "ROMA",
+		Provincia: "RM",
+		Lat:       "41.9",
+		Long:      "12.5",
+		LatF:      41.9,
+		LonF:      12.5,
+	}
+	if got := stations[1]; got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// the current layout has one more field.
+	if _, _, err := parseStations(strings.NewReader(csv), stationsSchemas[defaultStationsSchema]); err == nil {
+		t.Error("parsing the older layout with the current schema succeeded")
+	}
+}
+
+func TestStationsSchemaByName(t *testing.T) {
+	if _, err := stationsSchemaByName("v42"); err == nil {
+		t.Error("got no error for an unknown schema")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Station struct {
+	ID        int
+	Gestore   string
+	Bandiera  string
+	Tipo      StationType
+	Nome      string
+	Indirizzo string
+	Comune    string
+	Provincia string
+	Lat       string
+	Long      string
+	// LatF and LonF are Lat and Long parsed, or NaN if they are missing,
+	// not numeric or out of range.
+	LatF float64
+	LonF float64
+}
+
+type StationType string
+
+const (
+	StationTypeStradale     = "Stradale"
+	StationTypeAutostradale = "Autostradale"
+)
+
+// stationsStats are statistics collected while parsing a stations CSV file.
+type stationsStats struct {
+	// Rows is the number of data lines, i.e. excluding the header.
+	Rows int
+	// ConflictingDuplicates is the number of station IDs appearing more than
+	// once with different field values.
+	ConflictingDuplicates int
+}
+
+// parseStations parses a stations CSV file laid out according to `schema`.
+func parseStations(rd io.Reader, schema StationsSchema) (map[int]Station, stationsStats, error) {
+	var stats stationsStats
+	br := bufio.NewReader(rd)
+	stationMap := make(map[int]Station)
+	conflicting := make(map[int]bool)
+	scanner := bufio.NewScanner(br)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		// cannot use the csv package because the input CSV is malformed (unterminated quotes)
+		// and the csv package doesn't deal with that.
+		if lineno <= 2 {
+			// skip the first two lines. This is a non-compliant CSV with
+			// a two-line header: the extraction date, then the column
+			// names.
+			continue
+		}
+		stats.Rows++
+		line := scanner.Text()
+		items := strings.Split(line, ";")
+		if len(items) == 0 {
+			log.Printf("Warning: skipping empty line")
+			continue
+		}
+		station, err := parseStation(items, schema)
+		if err != nil {
+			return nil, stats, err
+		}
+		prev, ok := stationMap[station.ID]
+		if ok {
+			log.Printf("Warning: found duplicate type '%s' for station ID %d, using the latest value", station.Tipo, station.ID)
+		}
+		// a repeated row is harmless, different values for the same ID
+		// mean that the data is corrupted. The parsed coordinates are left
+		// out, they follow from Lat and Long and NaN is never equal to
+		// itself.
+		prev.LatF, prev.LonF = 0, 0
+		if ok && prev != station {
+			conflicting[station.ID] = true
+		}
+		station.LatF, station.LonF, err = parseCoordinates(station.Lat, station.Long)
+		if err != nil {
+			log.Printf("Warning: invalid coordinates for station ID %d: %v", station.ID, err)
+		}
+		stationMap[station.ID] = station
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, stats, fmt.Errorf("failed to scan stations CSV: %w", err)
+	}
+	stats.ConflictingDuplicates = len(conflicting)
+	return stationMap, stats, nil
+}
+
+// parseStation parses the fields of a line of the stations CSV file laid out
+// according to `schema`.
+func parseStation(items []string, schema StationsSchema) (Station, error) {
+	idImpianto, err := strconv.ParseInt(items[schema.ID], 10, 64)
+	if err != nil {
+		return Station{}, fmt.Errorf("IDImpianto is not a numeric string: %w", err)
+	}
+	// some lines have trailing empty fields (e.g. a trailing `;;`), drop
+	// them so that they parse like regular lines. Never go below the
+	// expected number of fields, since the last field may be legitimately
+	// empty.
+	for len(items) > schema.Fields && items[len(items)-1] == "" {
+		items = items[:len(items)-1]
+	}
+	address := ""
+	switch len(items) {
+	case schema.Fields:
+		address = items[schema.Indirizzo]
+	case schema.Fields + 1:
+		// there is a bug in the data source, where there can be one more item than expected.
+		// The extra field is a second version of the address, so we concatenate it to
+		// `Indirizzo`.
+		address = strings.Join(items[schema.Indirizzo:schema.Indirizzo+2], " | ")
+		// drop the extra field, so that the following ones are at their
+		// usual index.
+		items = append(items[:schema.Indirizzo+1], items[schema.Indirizzo+2:]...)
+	default:
+		return Station{}, fmt.Errorf("malformed line with %d fields instead of %d or %d: %q", len(items), schema.Fields, schema.Fields+1, items)
+	}
+	return Station{
+		ID:        int(idImpianto),
+		Gestore:   column(items, schema.Gestore),
+		Bandiera:  column(items, schema.Bandiera),
+		Tipo:      StationType(column(items, schema.Tipo)),
+		Nome:      column(items, schema.Nome),
+		Indirizzo: address,
+		Comune:    column(items, schema.Comune),
+		Provincia: column(items, schema.Provincia),
+		Lat:       column(items, schema.Lat),
+		Long:      column(items, schema.Long),
+	}, nil
+}
+
+// activeStations returns the stations with at least one price record
+// reported after `cutoff`.
+func activeStations(stations map[int]Station, records []*Record, cutoff time.Time) map[int]Station {
+	active := make(map[int]Station)
+	for _, record := range records {
+		if !record.DataComunicazione.After(cutoff) {
+			continue
+		}
+		if station, ok := stations[record.IDImpianto]; ok {
+			active[station.ID] = station
+		}
+	}
+	return active
+}
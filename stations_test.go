@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStationsTrailingEmptyFields(t *testing.T) {
+	csv := `Estrazione del 2023-10-12
+idImpianto;Gestore;Bandiera;Tipo Impianto;Nome Impianto;Indirizzo;Comune;Provincia;Latitudine;Longitudine
+1;Gestore 1;Eni;Stradale;Eni Roma;Via Roma 1;ROMA;RM;41.9;12.5;;
+`
+	stations, _, err := parseStations(strings.NewReader(csv), stationsSchemas[defaultStationsSchema])
+	if err != nil {
+		t.Fatalf("parseStations failed: %v", err)
+	}
+	want := Station{
+		ID:        1,
+		Gestore:   "Gestore 1",
+		Bandiera:  "Eni",
+		Tipo:      StationTypeStradale,
+		Nome:      "Eni Roma",
+		Indirizzo: "Via Roma 1",
+		Comune:    "ROMA",
+		Provincia: "RM",
+		Lat:       "41.9",
+		Long:      "12.5",
+		LatF:      41.9,
+		LonF:      12.5,
+	}
+	if got := stations[1]; got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestActiveStations(t *testing.T) {
+	now := time.Now()
+	stations := map[int]Station{
+		1: {ID: 1},
+		2: {ID: 2},
+	}
+	records := []*Record{
+		{IDImpianto: 1, DataComunicazione: now.Add(-48 * time.Hour)},
+		{IDImpianto: 1, DataComunicazione: now.Add(-72 * time.Hour)},
+		{IDImpianto: 2, DataComunicazione: now.Add(-48 * time.Hour)},
+		{IDImpianto: 2, DataComunicazione: now.Add(-time.Hour)},
+	}
+	active := activeStations(stations, records, now.Add(-24*time.Hour))
+	if _, ok := active[1]; ok {
+		t.Error("station 1, with only stale prices, is active")
+	}
+	if _, ok := active[2]; !ok {
+		t.Error("station 2, with a recent price, is not active")
+	}
+}
+
+func TestParseStations(t *testing.T) {
+	stations, stats, err := parseStations(strings.NewReader(testStationsCSV), stationsSchemas[defaultStationsSchema])
+	if err != nil {
+		t.Fatalf("parseStations failed: %v", err)
+	}
+	// both header lines are skipped.
+	if stats.Rows != 2 || len(stations) != 2 {
+		t.Fatalf("got %d rows and %d stations, want 2 and 2", stats.Rows, len(stations))
+	}
+	for id, want := range map[int][3]string{
+		1: {"Eni Roma", "ROMA", "RM"},
+		2: {"Q8 Milano", "MILANO", "MI"},
+	} {
+		s := stations[id]
+		if got := [3]string{s.Nome, s.Comune, s.Provincia}; got != want {
+			t.Errorf("got station %d %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestParseStationsConflictingDuplicates(t *testing.T) {
+	csv := testStationsCSV +
+		// a repeated row is not a conflict
+		"2;Gestore 2;Q8;Autostradale;Q8 Milano;Via Milano 2;MILANO;MI;45.4;9.1\n" +
+		// a different Bandiera is
+		"1;Gestore 1;IP;Stradale;Eni Roma;Via Roma 1;ROMA;RM;41.9;12.5\n"
+	_, stats, err := parseStations(strings.NewReader(csv), stationsSchemas[defaultStationsSchema])
+	if err != nil {
+		t.Fatalf("parseStations failed: %v", err)
+	}
+	if stats.ConflictingDuplicates != 1 {
+		t.Errorf("got %d conflicting duplicates, want 1", stats.ConflictingDuplicates)
+	}
+}
+
+func TestParseStationsTwoAddresses(t *testing.T) {
+	csv := `Estrazione del 2023-10-12
+idImpianto;Gestore;Bandiera;Tipo Impianto;Nome Impianto;Indirizzo;Comune;Provincia;Latitudine;Longitudine
+1;Gestore 1;Eni;Stradale;Eni Roma;Via Roma 1;Piazza Roma;ROMA;RM;41.9;12.5
+`
+	stations, _, err := parseStations(strings.NewReader(csv), stationsSchemas[defaultStationsSchema])
+	if err != nil {
+		t.Fatalf("parseStations failed: %v", err)
+	}
+	s := stations[1]
+	if s.Indirizzo != "Via Roma 1 | Piazza Roma" {
+		t.Errorf("got address %q, want both fields joined", s.Indirizzo)
+	}
+	if s.Comune != "ROMA" || s.Provincia != "RM" || s.Lat != "41.9" || s.Long != "12.5" {
+		t.Errorf("got misaligned fields %+v", s)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is the data set fetched by a single refresh. It must be treated as
+// read-only, since it is shared by all the readers of a Store.
+type Snapshot struct {
+	Records  []*Record
+	Stations map[int]Station
+	// Updated is when the snapshot was stored, or the zero time if no
+	// refresh succeeded yet.
+	Updated time.Time
+	// StationsUpdated is when the stations were last successfully fetched.
+	StationsUpdated time.Time
+}
+
+// churnWindow is the window over which station additions and removals are
+// counted.
+const churnWindow = 24 * time.Hour
+
+// churnEvent records how many stations were added and removed by an update.
+type churnEvent struct {
+	ts      time.Time
+	added   int
+	removed int
+}
+
+// averageWindow is the window of the rolling average of the prices.
+const averageWindow = 7 * 24 * time.Hour
+
+// priceKey identifies the prices of a fuel at a station.
+type priceKey struct {
+	IDImpianto  int
+	Carburante  string
+	SelfService bool
+}
+
+// priceSample is a price as reported at a given time.
+type priceSample struct {
+	ts    time.Time
+	price float64
+}
+
+// Store holds the latest successfully fetched snapshot. It is safe for
+// concurrent use.
+type Store struct {
+	mu       sync.RWMutex
+	snapshot Snapshot
+	churn    []churnEvent
+	// samples are the prices reported within averageWindow, oldest first,
+	// see Averages.
+	samples map[priceKey][]priceSample
+}
+
+// NewStore returns a new, empty, Store.
+func NewStore() *Store {
+	return &Store{samples: make(map[priceKey][]priceSample)}
+}
+
+// Update replaces the current snapshot with the given records and stations,
+// fetched at `stationsUpdated`, and records which stations were added or
+// removed since the previous one. The records are copied, see
+// compactRecords, so the caller's slice can be garbage collected.
+func (s *Store) Update(records []*Record, stations map[int]Station, stationsUpdated time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	// on the first update every station would count as added, which is not
+	// churn.
+	if s.snapshot.Stations != nil {
+		var ev churnEvent
+		ev.ts = now
+		for id := range stations {
+			if _, ok := s.snapshot.Stations[id]; !ok {
+				ev.added++
+			}
+		}
+		for id := range s.snapshot.Stations {
+			if _, ok := stations[id]; !ok {
+				ev.removed++
+			}
+		}
+		s.churn = append(s.churn, ev)
+	}
+	s.pruneChurn(now)
+	records = compactRecords(records)
+	s.addSamples(records, now)
+	s.snapshot = Snapshot{
+		Records:         records,
+		Stations:        stations,
+		Updated:         now,
+		StationsUpdated: stationsUpdated,
+	}
+}
+
+// compactRecords returns a copy of the records backed by a single array of
+// the exact size. Parsing leaves records spread over many allocations, and
+// their strings point into the buffers of the CSV reader: copying them lets
+// the garbage collector reclaim all of it once the parsed slice is dropped.
+// Fuel names are interned, since there are only a handful of them.
+func compactRecords(records []*Record) []*Record {
+	values := make([]Record, len(records))
+	compact := make([]*Record, len(records))
+	fuels := make(map[string]string)
+	for i, record := range records {
+		values[i] = *record
+		fuel, ok := fuels[record.Carburante]
+		if !ok {
+			fuel = strings.Clone(record.Carburante)
+			fuels[fuel] = fuel
+		}
+		values[i].Carburante = fuel
+		compact[i] = &values[i]
+	}
+	return compact
+}
+
+// pruneChurn drops the churn events older than churnWindow. It must be called
+// with the lock held.
+func (s *Store) pruneChurn(now time.Time) {
+	i := 0
+	for i < len(s.churn) && now.Sub(s.churn[i].ts) > churnWindow {
+		i++
+	}
+	if i > 0 {
+		// copy rather than reslice, so that the backing array does not
+		// grow forever.
+		s.churn = append([]churnEvent(nil), s.churn[i:]...)
+	}
+}
+
+// addSamples adds the newly reported prices to the samples, and drops the
+// ones older than averageWindow. It must be called with the lock held. The
+// samples of the prices no longer reported are dropped.
+func (s *Store) addSamples(records []*Record, now time.Time) {
+	samples := make(map[priceKey][]priceSample, len(records))
+	for _, record := range records {
+		k := priceKey{IDImpianto: record.IDImpianto, Carburante: record.Carburante, SelfService: record.SelfService}
+		prev := s.samples[k]
+		// a price is reported again by every refresh until it changes.
+		if n := len(prev); n == 0 || record.DataComunicazione.After(prev[n-1].ts) {
+			prev = append(prev, priceSample{ts: record.DataComunicazione, price: record.Prezzo})
+		}
+		// keep the last sample before the window, its price was in
+		// force at the start of the window.
+		i := 0
+		for i < len(prev)-1 && now.Sub(prev[i+1].ts) > averageWindow {
+			i++
+		}
+		samples[k] = prev[i:]
+	}
+	s.samples = samples
+}
+
+// Averages returns the average of the prices reported within averageWindow,
+// including the one in force at its start, for each fuel at each station.
+func (s *Store) Averages() map[priceKey]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	averages := make(map[priceKey]float64, len(s.samples))
+	for k, samples := range s.samples {
+		sum := 0.0
+		for _, sample := range samples {
+			sum += sample.price
+		}
+		averages[k] = sum / float64(len(samples))
+	}
+	return averages
+}
+
+// Churn returns the number of stations added and removed within the last
+// churnWindow.
+func (s *Store) Churn() (added, removed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneChurn(time.Now())
+	for _, ev := range s.churn {
+		added += ev.added
+		removed += ev.removed
+	}
+	return added, removed
+}
+
+// Snapshot returns the current snapshot.
+func (s *Store) Snapshot() Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreChurn(t *testing.T) {
+	s := NewStore()
+	update := func(ids ...int) {
+		stations := make(map[int]Station, len(ids))
+		for _, id := range ids {
+			stations[id] = Station{ID: id}
+		}
+		s.Update(nil, stations, time.Now())
+	}
+	update(1, 2)
+	if added, removed := s.Churn(); added != 0 || removed != 0 {
+		t.Errorf("got %d added and %d removed after the first update, want none", added, removed)
+	}
+	update(2, 3)
+	update(2, 3, 4)
+	if added, removed := s.Churn(); added != 2 || removed != 1 {
+		t.Errorf("got %d added and %d removed, want 2 and 1", added, removed)
+	}
+
+	// move the first change out of the window.
+	s.mu.Lock()
+	s.churn[0].ts = time.Now().Add(-churnWindow - time.Minute)
+	s.mu.Unlock()
+	if added, removed := s.Churn(); added != 1 || removed != 0 {
+		t.Errorf("got %d added and %d removed within the window, want 1 and 0", added, removed)
+	}
+}
+
+func TestRefreshMemoryDoesNotGrow(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(testPricesCSV)
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "%d;Benzina;1.899;1;12/10/2023 08:00:00\n", 100+i)
+	}
+	srv := newTestServer(t, b.String(), testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	heap := func() uint64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	refresh := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := e.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh failed: %v", err)
+			}
+		}
+	}
+	refresh(3)
+	before := heap()
+	refresh(20)
+	after := heap()
+	// allow for some noise, but not for retaining the data of every
+	// refresh.
+	if after > before+before/2 {
+		t.Errorf("heap grew from %d to %d bytes across refreshes", before, after)
+	}
+}
+
+func TestStoreAverages(t *testing.T) {
+	s := NewStore()
+	now := time.Now()
+	day := 24 * time.Hour
+	k := priceKey{IDImpianto: 1, Carburante: "Benzina", SelfService: true}
+	for _, sample := range []struct {
+		age   time.Duration
+		price float64
+	}{
+		// dropped, the next one is in force at the start of the window
+		{12 * day, 2},
+		{9 * day, 1.5},
+		{5 * day, 1.75},
+		{day, 1.25},
+		// a price is reported by every refresh until it changes
+		{day, 1.25},
+	} {
+		record := &Record{IDImpianto: 1, Carburante: "Benzina", SelfService: true, Prezzo: sample.price, DataComunicazione: now.Add(-sample.age)}
+		s.Update([]*Record{record}, nil, now)
+	}
+	if got := s.Averages()[k]; got != 1.5 {
+		t.Errorf("got a 7 day average of %v, want 1.5", got)
+	}
+}
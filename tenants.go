@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Filter selects price records by the province and comune of their station,
+// and by fuel type. Empty lists match everything. Matching is
+// case-insensitive.
+type Filter struct {
+	Provinces  []string `json:"provinces"`
+	Comuni     []string `json:"comuni"`
+	Carburanti []string `json:"carburanti"`
+	// ExcludeProvinces and ExcludeComuni reject the stations in the listed
+	// provinces and comuni, even if they match the lists above.
+	ExcludeProvinces []string `json:"exclude_provinces"`
+	ExcludeComuni    []string `json:"exclude_comuni"`
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the record matches the filter. Records without
+// station metadata never match a province or comune filter.
+func (f *Filter) Match(record *Record, stations map[int]Station) bool {
+	if len(f.Carburanti) > 0 && !containsFold(f.Carburanti, record.Carburante) {
+		return false
+	}
+	station, ok := stations[record.IDImpianto]
+	if !ok {
+		return len(f.Provinces) == 0 && len(f.Comuni) == 0
+	}
+	return f.MatchStation(station)
+}
+
+// MatchStation returns true if the station is not excluded and is in one of
+// the provinces and comuni of the filter, if any.
+func (f *Filter) MatchStation(station Station) bool {
+	if f.Excludes(station) {
+		return false
+	}
+	if len(f.Provinces) > 0 && !containsFold(f.Provinces, station.Provincia) {
+		return false
+	}
+	if len(f.Comuni) > 0 && !containsFold(f.Comuni, station.Comune) {
+		return false
+	}
+	return true
+}
+
+// Excludes returns true if the station is in an excluded province or comune.
+func (f *Filter) Excludes(station Station) bool {
+	return containsFold(f.ExcludeProvinces, station.Provincia) || containsFold(f.ExcludeComuni, station.Comune)
+}
+
+// empty returns true if the filter matches everything.
+func (f *Filter) empty() bool {
+	return len(f.Provinces) == 0 && len(f.Comuni) == 0 && len(f.Carburanti) == 0 &&
+		len(f.ExcludeProvinces) == 0 && len(f.ExcludeComuni) == 0
+}
+
+// filterStations removes the stations that do not match `f`, see
+// Filter.MatchStation, and the price records that do not match it, see
+// Filter.Match. It returns the remaining records and stations, and the number
+// of records removed.
+func filterStations(records []*Record, stations map[int]Station, f *Filter) ([]*Record, map[int]Station, int) {
+	if f.empty() {
+		return records, stations, 0
+	}
+	kept := make(map[int]Station, len(stations))
+	for id, station := range stations {
+		if f.MatchStation(station) {
+			kept[id] = station
+		}
+	}
+	keptRecords := make([]*Record, 0, len(records))
+	for _, record := range records {
+		if f.Match(record, stations) {
+			keptRecords = append(keptRecords, record)
+		}
+	}
+	return keptRecords, kept, len(records) - len(keptRecords)
+}
+
+// Tenant is a set of filtered prices exposed on its own HTTP path.
+type Tenant struct {
+	Path   string `json:"path"`
+	Filter Filter `json:"filter"`
+}
+
+// loadTenants reads a JSON file containing a list of tenants, e.g.
+//
+//	[{"path": "/metrics/lazio", "filter": {"provinces": ["RM", "LT", "FR", "RI", "VT"]}}]
+func loadTenants(path string) ([]Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+	var tenants []Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+	paths := make(map[string]struct{}, len(tenants))
+	for _, t := range tenants {
+		if !strings.HasPrefix(t.Path, "/") {
+			return nil, fmt.Errorf("tenant path %q must start with /", t.Path)
+		}
+		if _, ok := paths[t.Path]; ok {
+			return nil, fmt.Errorf("duplicate tenant path %q", t.Path)
+		}
+		paths[t.Path] = struct{}{}
+	}
+	return tenants, nil
+}
+
+// TenantHandler returns an http.Handler serving the prices matching the
+// tenant's filter, from a registry of its own. The data is shared with the
+// exporter, and is not fetched again.
+func (e *Exporter) TenantHandler(t Tenant) (http.Handler, error) {
+	registry := prometheus.NewRegistry()
+	reg := instanceRegisterer(registry, e.cfg.InstanceLabels)
+	filter := t.Filter
+	prices := e.newPriceCollector(&filter)
+	if err := reg.Register(prices); err != nil {
+		return nil, fmt.Errorf("failed to register price metric for tenant %q: %w", t.Path, err)
+	}
+	// tenants' metrics are already in the exporter's catalog.
+	if err := registerSeriesMetrics(reg, prices, nil); err != nil {
+		return nil, fmt.Errorf("failed to register series metrics for tenant %q: %w", t.Path, err)
+	}
+	return e.handlerFor(registry), nil
+}
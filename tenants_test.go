@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	for _, tt := range []struct {
+		tenant       Tenant
+		want, unwant string
+	}{
+		{Tenant{Path: "/metrics/lazio", Filter: Filter{Provinces: []string{"RM"}}}, `IDImpianto="1"`, `IDImpianto="2"`},
+		{Tenant{Path: "/metrics/lombardia", Filter: Filter{Provinces: []string{"MI"}}}, `IDImpianto="2"`, `IDImpianto="1"`},
+	} {
+		h, err := e.TenantHandler(tt.tenant)
+		if err != nil {
+			t.Fatalf("TenantHandler failed: %v", err)
+		}
+		w := scrape(t, h, tt.tenant.Path)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, tt.want) || strings.Contains(body, tt.unwant) {
+			t.Errorf("%s: got prices not matching the filter:\n%s", tt.tenant.Path, body)
+		}
+	}
+}
+
+func TestFilterExclusions(t *testing.T) {
+	stations := map[int]Station{
+		1: {ID: 1, Provincia: "RM", Comune: "ROMA"},
+		2: {ID: 2, Provincia: "RM", Comune: "FIUMICINO"},
+		3: {ID: 3, Provincia: "LT", Comune: "LATINA"},
+	}
+	f := &Filter{
+		Provinces:        []string{"RM", "LT"},
+		ExcludeProvinces: []string{"LT"},
+		ExcludeComuni:    []string{"fiumicino"},
+	}
+	for id, want := range map[int]bool{1: true, 2: false, 3: false} {
+		if got := f.MatchStation(stations[id]); got != want {
+			t.Errorf("station %d: got match %t, want %t", id, got, want)
+		}
+	}
+	records := []*Record{{IDImpianto: 1}, {IDImpianto: 2}, {IDImpianto: 3}}
+	kept, keptStations, removed := filterStations(records, stations, f)
+	if len(kept) != 1 || kept[0].IDImpianto != 1 || len(keptStations) != 1 || removed != 2 {
+		t.Errorf("got %d records, %d stations and %d removed, want only station 1", len(kept), len(keptStations), removed)
+	}
+}
+
+func TestProvinceFilter(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{Filter: Filter{Provinces: splitList("rm,NA")}})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	for _, record := range e.store.Snapshot().Records {
+		if record.IDImpianto == 2 {
+			t.Errorf("got the record %+v of a station in MI", record)
+		}
+	}
+	if got := len(e.store.Snapshot().Records); got != 2 {
+		t.Errorf("got %d records, want the 2 in RM", got)
+	}
+}
+
+func TestCarburanteFilter(t *testing.T) {
+	srv := newTestServer(t, testPricesCSV, testStationsCSV)
+	e := newTestExporter(t, srv, Config{Filter: Filter{Carburanti: splitList("gasolio")}})
+	if err := e.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	records := e.store.Snapshot().Records
+	if len(records) != 1 || records[0].Carburante != "Gasolio" {
+		t.Errorf("got records %v, want only the Gasolio one", records)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "fmt"
+
+// Validator checks a parsed price record, returning an error if the record
+// must be dropped.
+type Validator func(*Record) error
+
+// NamedValidator is a Validator with a name, used to attribute dropped
+// records in the metrics.
+type NamedValidator struct {
+	Name     string
+	Validate Validator
+}
+
+// minPriceValidator rejects records with a price lower than `min`.
+func minPriceValidator(min float64) NamedValidator {
+	return NamedValidator{
+		Name: "min_price",
+		Validate: func(r *Record) error {
+			if r.Prezzo < min {
+				return fmt.Errorf("price %f is lower than %f", r.Prezzo, min)
+			}
+			return nil
+		},
+	}
+}
+
+// maxPriceValidator rejects records with a price higher than `max`.
+func maxPriceValidator(max float64) NamedValidator {
+	return NamedValidator{
+		Name: "max_price",
+		Validate: func(r *Record) error {
+			if r.Prezzo > max {
+				return fmt.Errorf("price %f is higher than %f", r.Prezzo, max)
+			}
+			return nil
+		},
+	}
+}
+
+// validateRecords applies the validators, in order, to every record. It
+// returns the records that pass all of them, and the number of records
+// dropped by each validator. A record is attributed to the first validator
+// that rejects it.
+func validateRecords(records []*Record, validators []NamedValidator) ([]*Record, map[string]int) {
+	if len(validators) == 0 {
+		return records, nil
+	}
+	valid := make([]*Record, 0, len(records))
+	dropped := make(map[string]int)
+	for _, record := range records {
+		ok := true
+		for _, v := range validators {
+			if err := v.Validate(record); err != nil {
+				dropped[v.Name]++
+				ok = false
+				break
+			}
+		}
+		if ok {
+			valid = append(valid, record)
+		}
+	}
+	return valid, dropped
+}
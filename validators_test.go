@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateRecords(t *testing.T) {
+	records := []*Record{
+		{IDImpianto: 1, Prezzo: 0.1},
+		{IDImpianto: 2, Prezzo: 1.9},
+		{IDImpianto: 3, Prezzo: 9},
+		{IDImpianto: 4, Prezzo: 10},
+	}
+	valid, dropped := validateRecords(records, []NamedValidator{minPriceValidator(0.5), maxPriceValidator(5)})
+	if len(valid) != 1 || valid[0].IDImpianto != 2 {
+		t.Errorf("got valid records %v, want only station 2", valid)
+	}
+	want := map[string]int{"min_price": 1, "max_price": 2}
+	if !reflect.DeepEqual(dropped, want) {
+		t.Errorf("got dropped records %v, want %v", dropped, want)
+	}
+}